@@ -0,0 +1,318 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/coreos/yaml"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/os/config/cloudinit/config"
+	"github.com/urfave/cli"
+)
+
+func CloudInitCommand() cli.Command {
+	return cli.Command{
+		Name:  "cloud-init",
+		Usage: "Inspect cloud-init documents",
+		Subcommands: []cli.Command{
+			{
+				Name:      "validate",
+				Usage:     "Lint cloud-init sources and list the directives exec would apply",
+				ArgsUsage: "[file ...]",
+				Action:    cloudInitValidateAction,
+				Flags: append([]cli.Flag{
+					cli.BoolFlag{
+						Name:  "metadata",
+						Usage: "include /self/service/metadata/cloud-init",
+					},
+				}, cloudInitSourceFlags()...),
+			},
+		},
+	}
+}
+
+func cloudInitSourceFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "cloud-init-label",
+			Usage: "read a cloud-init document from this label of the container",
+		},
+		cli.StringSliceFlag{
+			Name:  "cloud-init-file",
+			Usage: "read a cloud-init document from a file. Can use the flag multiple times",
+		},
+		cli.StringFlag{
+			Name:  "cloud-init-env",
+			Usage: "read a cloud-init document, as YAML or base64 encoded YAML, from this environment variable",
+		},
+	}
+}
+
+// cloudInitSource is a cloud-init document and where it came from.
+type cloudInitSource struct {
+	name    string
+	content string
+}
+
+// decodeInlineDocument accepts a document that is either YAML or base64
+// encoded YAML, as is convenient for environment variables and labels.
+func decodeInlineDocument(value string) string {
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value)); err == nil {
+		return string(decoded)
+	}
+	return value
+}
+
+// CloudInitSources names where cloud-init documents are read from.
+type CloudInitSources struct {
+	Metadata bool     `yaml:"metadata"`
+	Label    string   `yaml:"label"`
+	Files    []string `yaml:"files"`
+	Env      string   `yaml:"env"`
+}
+
+func newCloudInitSources(c *cli.Context, fromMetadata bool) CloudInitSources {
+	return CloudInitSources{
+		Metadata: fromMetadata,
+		Label:    c.String("cloud-init-label"),
+		Files:    c.StringSlice("cloud-init-file"),
+		Env:      c.String("cloud-init-env"),
+	}
+}
+
+func (s CloudInitSources) empty() bool {
+	return !s.Metadata && s.Label == "" && len(s.Files) == 0 && s.Env == ""
+}
+
+// loadCloudInitSources reads cloud-init documents in order of increasing
+// precedence: service metadata, container label, files, environment.
+func loadCloudInitSources(metadataURL string, s CloudInitSources) ([]cloudInitSource, error) {
+	sources := []cloudInitSource{}
+
+	var mdClient metadata.Client
+	if s.Metadata || s.Label != "" {
+		var err error
+		if mdClient, err = metadata.NewClientAndWait(metadataURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Metadata {
+		self, err := mdClient.GetSelfService()
+		if err != nil {
+			return nil, err
+		}
+		if doc, ok := self.Metadata["cloud-init"]; ok {
+			jsonBytes, err := json.Marshal(doc)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, cloudInitSource{"service metadata", string(jsonBytes)})
+		}
+	}
+
+	if s.Label != "" {
+		self, err := mdClient.GetSelfContainer()
+		if err != nil {
+			return nil, err
+		}
+		if value, ok := self.Labels[s.Label]; ok {
+			sources = append(sources, cloudInitSource{"label " + s.Label, decodeInlineDocument(value)})
+		}
+	}
+
+	for _, file := range s.Files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, cloudInitSource{"file " + file, string(content)})
+	}
+
+	if s.Env != "" {
+		if value, ok := os.LookupEnv(s.Env); ok {
+			sources = append(sources, cloudInitSource{"env " + s.Env, decodeInlineDocument(value)})
+		}
+	}
+
+	return sources, nil
+}
+
+func parseCloudInitSources(sources []cloudInitSource) ([]*CloudInitConfig, error) {
+	configs := []*CloudInitConfig{}
+	for _, source := range sources {
+		cfg, err := NewCloudInitConfig(source.content)
+		if err != nil {
+			return nil, fmt.Errorf("cloud-init %s: %v", source.name, err)
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
+
+// mergeCloudInit combines documents given in order of increasing
+// precedence. bootcmd and runcmd entries are concatenated. A file from a
+// later document replaces earlier entries for the same path, unless it is
+// appended to them.
+func mergeCloudInit(configs []*CloudInitConfig) *CloudInitConfig {
+	merged := &CloudInitConfig{}
+	for _, cfg := range configs {
+		merged.Bootcmd = append(merged.Bootcmd, cfg.Bootcmd...)
+		merged.Runcmd = append(merged.Runcmd, cfg.Runcmd...)
+
+		for _, file := range cfg.WriteFiles {
+			if !file.Append {
+				kept := []CloudInitFile{}
+				for _, existing := range merged.WriteFiles {
+					if existing.Path != file.Path {
+						kept = append(kept, existing)
+					}
+				}
+				merged.WriteFiles = kept
+			}
+			merged.WriteFiles = append(merged.WriteFiles, file)
+		}
+	}
+	return merged
+}
+
+func loadCloudInit(metadataURL string, s CloudInitSources) (*CloudInitConfig, error) {
+	sources, err := loadCloudInitSources(metadataURL, s)
+	if err != nil {
+		return nil, err
+	}
+
+	configs, err := parseCloudInitSources(sources)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeCloudInit(configs), nil
+}
+
+// Directives describes, in order, what Apply would do. Problems found along
+// the way are returned as errors.
+func (cc *CloudInitConfig) Directives() ([]string, []error) {
+	directives := []string{}
+	errs := []error{}
+
+	describeCommands := func(section string, entries []interface{}) {
+		for i, entry := range entries {
+			directive := fmt.Sprintf("%s[%d]", section, i)
+			args, err := cloudInitArgs(entry)
+			if err != nil {
+				errs = append(errs, &CloudInitError{directive, err})
+				continue
+			}
+			directives = append(directives, fmt.Sprintf("%s: run %q", directive, args))
+		}
+	}
+
+	describeCommands("bootcmd", cc.Bootcmd)
+
+	for i, file := range cc.WriteFiles {
+		directive := fmt.Sprintf("write_files[%d] (%s)", i, file.Path)
+		perm, _, _, err := file.validate()
+		if err == nil {
+			_, err = config.DecodeContent(file.Content, file.Encoding)
+		}
+		if err != nil {
+			errs = append(errs, &CloudInitError{directive, err})
+			continue
+		}
+
+		action := "write"
+		if file.Append {
+			action = "append to"
+		}
+		details := []string{}
+		if !file.Append || file.Permissions != nil {
+			details = append(details, fmt.Sprintf("mode %#o", perm))
+		}
+		if file.Owner != "" {
+			details = append(details, "owner "+file.Owner)
+		}
+		if file.Encoding != "" {
+			details = append(details, "encoding "+file.Encoding)
+		}
+
+		description := fmt.Sprintf("write_files[%d]: %s %s", i, action, file.Path)
+		if len(details) > 0 {
+			description += " (" + strings.Join(details, ", ") + ")"
+		}
+		directives = append(directives, description)
+	}
+
+	describeCommands("runcmd", cc.Runcmd)
+
+	return directives, errs
+}
+
+var supportedCloudInitKeys = map[string]bool{
+	"bootcmd":     true,
+	"write_files": true,
+	"runcmd":      true,
+}
+
+// unsupportedCloudInitKeys lists the top level keys of a document that exec
+// ignores.
+func unsupportedCloudInitKeys(content string) []string {
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return nil
+	}
+
+	keys := []string{}
+	for key := range doc {
+		if !supportedCloudInitKeys[strings.Replace(key, "-", "_", -1)] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func cloudInitValidateAction(c *cli.Context) error {
+	s := newCloudInitSources(c, c.Bool("metadata"))
+	s.Files = append(s.Files, c.Args()...)
+	sources, err := loadCloudInitSources(c.GlobalString("metadata-url"), s)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("No cloud-init sources given")
+	}
+
+	failed := false
+	for _, source := range sources {
+		fmt.Printf("Source: %s\n", source.name)
+		for _, key := range unsupportedCloudInitKeys(source.content) {
+			fmt.Printf("  warning: %s is not supported and will be ignored\n", key)
+		}
+	}
+
+	configs, err := parseCloudInitSources(sources)
+	if err != nil {
+		return err
+	}
+
+	directives, errs := mergeCloudInit(configs).Directives()
+	fmt.Println("Directives:")
+	for _, directive := range directives {
+		fmt.Printf("  %s\n", directive)
+	}
+	for _, err := range errs {
+		fmt.Printf("  error: %v\n", err)
+		failed = true
+	}
+
+	if failed {
+		return fmt.Errorf("cloud-init validation failed")
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// fakeMetadata serves the given documents, by path, as a Rancher metadata
+// service would.
+func fakeMetadata(documents map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/version" {
+			w.Write([]byte("1"))
+			return
+		}
+		doc, ok := documents[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(doc)
+	}))
+}
+
+func TestLoadCloudInitPrecedence(t *testing.T) {
+	label := "runcmd: [echo label]\nwrite_files:\n- path: /b\n  content: label\n"
+	server := fakeMetadata(map[string]interface{}{
+		"/self/service": map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"cloud-init": map[string]interface{}{
+					"bootcmd":     []string{"echo metadata"},
+					"write_files": []map[string]string{{"path": "/a", "content": "metadata"}},
+				},
+			},
+		},
+		"/self/container": map[string]interface{}{
+			"labels": map[string]string{"cloud-init": base64.StdEncoding.EncodeToString([]byte(label))},
+		},
+	})
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cloudinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cloud-config.yml")
+	writeTree(t, dir, map[string]string{
+		"cloud-config.yml": "bootcmd: [echo file]\nwrite-files:\n- path: /a\n  content: file\n- path: /b\n  content: more\n  append: true\n",
+	}, nil)
+
+	os.Setenv("GIDDYUP_TEST_CLOUD_INIT", "runcmd:\n- [echo, env]\nwrite_files:\n- path: /a\n  content: env\n")
+	defer os.Unsetenv("GIDDYUP_TEST_CLOUD_INIT")
+
+	cfg, err := loadCloudInit(server.URL, CloudInitSources{
+		Metadata: true,
+		Label:    "cloud-init",
+		Files:    []string{file},
+		Env:      "GIDDYUP_TEST_CLOUD_INIT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []interface{}{"echo metadata", "echo file"}; !reflect.DeepEqual(cfg.Bootcmd, want) {
+		t.Errorf("bootcmd is %q, want %q", cfg.Bootcmd, want)
+	}
+	if want := []interface{}{"echo label", []interface{}{"echo", "env"}}; !reflect.DeepEqual(cfg.Runcmd, want) {
+		t.Errorf("runcmd is %q, want %q", cfg.Runcmd, want)
+	}
+
+	// /a is replaced by every later source, /b is appended to.
+	files := []string{}
+	for _, f := range cfg.WriteFiles {
+		files = append(files, f.Path+"="+f.Content)
+	}
+	if want := []string{"/b=label", "/b=more", "/a=env"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("write_files are %q, want %q", files, want)
+	}
+}
+
+func TestMergeCloudInitWithoutSources(t *testing.T) {
+	cfg := mergeCloudInit(nil)
+	if len(cfg.Bootcmd) != 0 || len(cfg.WriteFiles) != 0 || len(cfg.Runcmd) != 0 {
+		t.Fatalf("got %+v, want an empty document", cfg)
+	}
+}
+
+func TestCloudInitApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write([]byte("gzip"))
+	writer.Close()
+
+	writeTree(t, dir, map[string]string{"appended": "first\n"}, nil)
+	log := path("log")
+	cfg := &CloudInitConfig{
+		Bootcmd: []interface{}{"echo bootcmd >> " + log},
+		WriteFiles: []CloudInitFile{
+			{Path: path("plain"), Content: "plain", Permissions: "0600"},
+			{Path: path("b64"), Content: base64.StdEncoding.EncodeToString([]byte("b64")), Encoding: "b64"},
+			{Path: path("gzip"), Content: gzipped.String(), Encoding: "gzip"},
+			{Path: path("gzip+b64"), Content: base64.StdEncoding.EncodeToString(gzipped.Bytes()), Encoding: "gzip+b64"},
+			{Path: path("sub/dir/file"), Content: "nested", Permissions: 0640},
+			{Path: path("appended"), Content: "second\n", Append: true},
+		},
+		Runcmd: []interface{}{[]interface{}{"/bin/sh", "-c", "cat " + path("plain") + " >> " + log}},
+	}
+	if err := cfg.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"plain":        "plain",
+		"b64":          "b64",
+		"gzip":         "gzip",
+		"gzip+b64":     "gzip",
+		"sub/dir/file": "nested",
+		"appended":     "first\nsecond\n",
+		"log":          "bootcmd\nplain",
+	}
+	for name, content := range want {
+		got, err := ioutil.ReadFile(path(name))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, content)
+		}
+	}
+
+	modes := map[string]os.FileMode{"plain": 0600, "b64": 0644, "sub/dir/file": 0640}
+	for name, mode := range modes {
+		if info, err := os.Stat(path(name)); err != nil || info.Mode().Perm() != mode {
+			t.Errorf("%s: got mode %v, want %v", name, info.Mode(), mode)
+		}
+	}
+
+	cfg = &CloudInitConfig{Runcmd: []interface{}{"true", "exit 2", "touch " + path("never")}}
+	if err := cfg.Apply(); err == nil || err.Error() != "cloud-init runcmd[1]: exit status 2" {
+		t.Fatalf("got %v, want runcmd[1] to fail", err)
+	}
+	if _, err := os.Stat(path("never")); err == nil {
+		t.Fatal("runcmd continued after a failure")
+	}
+}
+
+// runValidate runs cloud-init validate with args and returns its output.
+func runValidate(t *testing.T, args ...string) (string, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	output := make(chan string)
+	go func() {
+		content, _ := ioutil.ReadAll(reader)
+		output <- string(content)
+	}()
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{CloudInitCommand()}
+	err = app.Run(append([]string{"giddyup", "cloud-init", "validate"}, args...))
+	writer.Close()
+	return <-output, err
+}
+
+func TestCloudInitValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{
+		"valid.yml": "write_files:\n- path: /etc/app.conf\n  content: x\n- path: /etc/app.log\n  content: eA==\n  encoding: b64\n  append: true\n  owner: root:root\nruncmd: [app --init]\n",
+		"invalid.yml": "#cloud-config\nhostname: app\nssh_authorized_keys: []\nbootcmd:\n- []\n- [echo, {a: b}]\nwrite_files:\n" +
+			"- content: no path\n- path: /etc/mode\n  permissions: '0999'\n- path: /etc/owner\n  owner: nosuchuser\n- path: /etc/b64\n  content: '!!'\n  encoding: b64\n- path: /etc/enc\n  encoding: rot13\n",
+		"broken.yml": "runcmd: [\n",
+	}, nil)
+
+	output, err := runValidate(t, filepath.Join(dir, "valid.yml"))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	want := "Source: file " + filepath.Join(dir, "valid.yml") + "\n" +
+		"Directives:\n" +
+		"  write_files[0]: write /etc/app.conf (mode 0644)\n" +
+		"  write_files[1]: append to /etc/app.log (owner root:root, encoding b64)\n" +
+		"  runcmd[0]: run [\"/bin/sh\" \"-c\" \"app --init\"]\n"
+	if output != want {
+		t.Fatalf("got\n%s\nwant\n%s", output, want)
+	}
+
+	output, err = runValidate(t, filepath.Join(dir, "invalid.yml"))
+	if err == nil || err.Error() != "cloud-init validation failed" {
+		t.Fatalf("got %v, want validation to fail", err)
+	}
+	for _, line := range []string{
+		"  warning: hostname is not supported and will be ignored\n",
+		"  warning: ssh_authorized_keys is not supported and will be ignored\n",
+		"  error: cloud-init bootcmd[0]: empty command\n",
+		"  error: cloud-init bootcmd[1]: invalid argument map[a:b]\n",
+		"  error: cloud-init write_files[0] (): path is required\n",
+		"  error: cloud-init write_files[1] (/etc/mode): invalid permissions \"0999\"\n",
+		"  error: cloud-init write_files[2] (/etc/owner): ",
+		"  error: cloud-init write_files[3] (/etc/b64): ",
+		"  error: cloud-init write_files[4] (/etc/enc): ",
+	} {
+		if !strings.Contains(output, line) {
+			t.Errorf("output does not contain %q:\n%s", line, output)
+		}
+	}
+
+	if _, err := runValidate(t, filepath.Join(dir, "broken.yml")); err == nil || !strings.Contains(err.Error(), "cloud-init file "+filepath.Join(dir, "broken.yml")) {
+		t.Fatalf("got %v, want a parse error naming the file", err)
+	}
+	if _, err := runValidate(t); err == nil || err.Error() != "No cloud-init sources given" {
+		t.Fatalf("got %v, want an error without sources", err)
+	}
+}
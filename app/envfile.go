@@ -0,0 +1,478 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// EnvFileError reports a problem at a specific line of an environment file.
+type EnvFileError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e *EnvFileError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Message)
+}
+
+// envLookup resolves variables referenced as ${VAR} or $VAR.
+type envLookup func(string) (string, bool)
+
+// readEnvFile parses file according to format, which is one of env, json,
+// yaml, properties or auto to pick a format from the file extension.
+func readEnvFile(file, format string, lookup envLookup) (map[string]string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == "" || format == "auto" {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".json":
+			format = "json"
+		case ".yaml", ".yml":
+			format = "yaml"
+		case ".properties":
+			format = "properties"
+		default:
+			format = "env"
+		}
+	}
+
+	switch format {
+	case "env":
+		return parseDotEnv(file, content, lookup)
+	case "json":
+		return parseJSONEnv(file, content)
+	case "yaml":
+		return parseYAMLEnv(file, content)
+	case "properties":
+		return parseProperties(file, content)
+	}
+	return nil, fmt.Errorf("Unknown source file format: %s", format)
+}
+
+type dotEnvParser struct {
+	file    string
+	content []byte
+	pos     int
+	line    int
+	lookup  envLookup
+	envs    map[string]string
+}
+
+// parseDotEnv parses KEY=value lines as understood by docker and most shell
+// tools: an optional export prefix, comments, single quoted literals, double
+// quoted values with escapes, ${VAR} expansion and multi-line quoted values.
+func parseDotEnv(file string, content []byte, lookup envLookup) (map[string]string, error) {
+	p := &dotEnvParser{
+		file:    file,
+		content: content,
+		line:    1,
+		lookup:  lookup,
+		envs:    map[string]string{},
+	}
+
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return p.envs, nil
+		}
+		if err := p.parseLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *dotEnvParser) errorf(format string, args ...interface{}) error {
+	return &EnvFileError{File: p.file, Line: p.line, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *dotEnvParser) eof() bool {
+	return p.pos >= len(p.content)
+}
+
+func (p *dotEnvParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.content[p.pos]
+}
+
+func (p *dotEnvParser) next() byte {
+	c := p.content[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+func (p *dotEnvParser) skipSpaces() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.next()
+	}
+}
+
+// skipBlank skips whitespace, empty lines and comment lines.
+func (p *dotEnvParser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.next()
+		case '#':
+			p.skipToEOL()
+		default:
+			return
+		}
+	}
+}
+
+func (p *dotEnvParser) skipToEOL() {
+	for !p.eof() && p.peek() != '\n' {
+		p.next()
+	}
+}
+
+// endLine accepts only whitespace and a comment before the end of the line.
+func (p *dotEnvParser) endLine() error {
+	p.skipSpaces()
+	switch {
+	case p.eof():
+		return nil
+	case p.peek() == '#':
+		p.skipToEOL()
+		return nil
+	case p.peek() == '\r' || p.peek() == '\n':
+		p.next()
+		return nil
+	}
+	return p.errorf("unexpected character %q after value", p.peek())
+}
+
+func isEnvKeyChar(c byte, first bool) bool {
+	switch {
+	case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		return true
+	case !first && (c >= '0' && c <= '9' || c == '.'):
+		return true
+	}
+	return false
+}
+
+func (p *dotEnvParser) parseKey() (string, error) {
+	start := p.pos
+	for !p.eof() && isEnvKeyChar(p.peek(), p.pos == start) {
+		p.next()
+	}
+	if p.pos == start {
+		return "", p.errorf("invalid variable name")
+	}
+	return string(p.content[start:p.pos]), nil
+}
+
+func (p *dotEnvParser) parseLine() error {
+	key, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+
+	if key == "export" && (p.peek() == ' ' || p.peek() == '\t') {
+		p.skipSpaces()
+		if key, err = p.parseKey(); err != nil {
+			return err
+		}
+	}
+
+	p.skipSpaces()
+	if p.eof() || p.peek() != '=' {
+		return p.errorf("expected '=' after %s", key)
+	}
+	p.next()
+	p.skipSpaces()
+
+	var value string
+	switch p.peek() {
+	case '\'':
+		value, err = p.parseSingleQuoted()
+	case '"':
+		value, err = p.parseDoubleQuoted()
+	default:
+		value, err = p.parseUnquoted()
+	}
+	if err != nil {
+		return err
+	}
+
+	p.envs[key] = value
+	return p.endLine()
+}
+
+func (p *dotEnvParser) parseSingleQuoted() (string, error) {
+	startLine := p.line
+	p.next()
+	start := p.pos
+	for !p.eof() {
+		if p.peek() == '\'' {
+			value := string(p.content[start:p.pos])
+			p.next()
+			return value, nil
+		}
+		p.next()
+	}
+	p.line = startLine
+	return "", p.errorf("unterminated single quoted value")
+}
+
+func (p *dotEnvParser) parseDoubleQuoted() (string, error) {
+	startLine := p.line
+	p.next()
+	start := p.pos
+	for !p.eof() {
+		switch p.next() {
+		case '\\':
+			if !p.eof() {
+				p.next()
+			}
+		case '"':
+			return p.interpolate(string(p.content[start:p.pos-1]), true)
+		}
+	}
+	p.line = startLine
+	return "", p.errorf("unterminated double quoted value")
+}
+
+func (p *dotEnvParser) parseUnquoted() (string, error) {
+	start := p.pos
+	for !p.eof() && p.peek() != '\n' {
+		// A # only starts a comment when preceded by whitespace.
+		if p.peek() == '#' && p.pos > start && (p.content[p.pos-1] == ' ' || p.content[p.pos-1] == '\t') {
+			break
+		}
+		p.next()
+	}
+	return p.interpolate(strings.TrimRight(string(p.content[start:p.pos]), " \t\r"), false)
+}
+
+// interpolate substitutes $VAR, ${VAR} and ${VAR:-default} and, for double
+// quoted values, processes backslash escapes. Variables defined earlier in
+// the file take precedence over the lookup.
+func (p *dotEnvParser) interpolate(value string, escapes bool) (string, error) {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case escapes && c == '\\' && i+1 < len(value):
+			i++
+			switch value[i] {
+			case 'n':
+				buf.WriteByte('\n')
+			case 't':
+				buf.WriteByte('\t')
+			case 'r':
+				buf.WriteByte('\r')
+			case '\n':
+				// Line continuation.
+			default:
+				buf.WriteByte(value[i])
+			}
+		case c == '$' && i+1 < len(value) && value[i+1] == '{':
+			end := strings.IndexByte(value[i:], '}')
+			if end < 0 {
+				return "", p.errorf("unterminated variable reference in %q", value)
+			}
+			ref := value[i+2 : i+end]
+			name, def, hasDefault := ref, "", false
+			if idx := strings.Index(ref, ":-"); idx >= 0 {
+				name, def, hasDefault = ref[:idx], ref[idx+2:], true
+			}
+			val, ok := p.resolve(name)
+			if (!ok || val == "") && hasDefault {
+				val = def
+			}
+			buf.WriteString(val)
+			i += end
+		case c == '$' && i+1 < len(value) && isEnvKeyChar(value[i+1], true):
+			j := i + 1
+			for j < len(value) && isEnvKeyChar(value[j], j == i+1) && value[j] != '.' {
+				j++
+			}
+			val, _ := p.resolve(value[i+1 : j])
+			buf.WriteString(val)
+			i = j - 1
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String(), nil
+}
+
+func (p *dotEnvParser) resolve(name string) (string, bool) {
+	if val, ok := p.envs[name]; ok {
+		return val, true
+	}
+	if p.lookup != nil {
+		return p.lookup(name)
+	}
+	return "", false
+}
+
+func scalarEnvs(file string, values map[string]interface{}) (map[string]string, error) {
+	envs := map[string]string{}
+	for key, value := range values {
+		switch v := value.(type) {
+		case nil:
+			envs[key] = ""
+		case string:
+			envs[key] = v
+		case json.Number:
+			envs[key] = v.String()
+		case bool, int, int64, uint64, float64:
+			envs[key] = fmt.Sprint(v)
+		default:
+			return nil, &EnvFileError{File: file, Message: fmt.Sprintf("value of %s is not a scalar", key)}
+		}
+	}
+	return envs, nil
+}
+
+func parseJSONEnv(file string, content []byte) (map[string]string, error) {
+	values := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		line := 0
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line = 1 + bytes.Count(content[:syntaxErr.Offset], []byte("\n"))
+		}
+		return nil, &EnvFileError{File: file, Line: line, Message: err.Error()}
+	}
+	return scalarEnvs(file, values)
+}
+
+func parseYAMLEnv(file string, content []byte) (map[string]string, error) {
+	values := map[string]interface{}{}
+	// Keys are variable names, so they are kept exactly as written.
+	identity := func(name string) string { return name }
+	if err := unmarshalYAML(content, &values, identity); err != nil {
+		// yaml errors already carry the line number.
+		return nil, &EnvFileError{File: file, Message: err.Error()}
+	}
+	return scalarEnvs(file, values)
+}
+
+// parseProperties parses the Java properties format: key=value, key: value
+// or key value, with ! or # comments, backslash line continuations and
+// escapes.
+func parseProperties(file string, content []byte) (map[string]string, error) {
+	envs := map[string]string{}
+	lines := strings.Split(string(content), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimLeft(strings.TrimRight(lines[i], "\r"), " \t\f")
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+
+		// An odd number of trailing backslashes continues the line.
+		for strings.HasSuffix(line, `\`) && (len(line)-len(strings.TrimRight(line, `\`)))%2 == 1 && i+1 < len(lines) {
+			i++
+			line = line[:len(line)-1] + strings.TrimLeft(strings.TrimRight(lines[i], "\r"), " \t\f")
+		}
+
+		sep := len(line)
+		for j := 0; j < len(line); j++ {
+			if line[j] == '\\' {
+				j++
+				continue
+			}
+			if line[j] == '=' || line[j] == ':' || line[j] == ' ' || line[j] == '\t' {
+				sep = j
+				break
+			}
+		}
+
+		key, err := unescapeProperty(line[:sep])
+		if err != nil {
+			return nil, &EnvFileError{File: file, Line: lineNo, Message: err.Error()}
+		}
+
+		rest := strings.TrimLeft(line[sep:], " \t\f")
+		if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+			rest = strings.TrimLeft(rest[1:], " \t\f")
+		}
+		value, err := unescapeProperty(rest)
+		if err != nil {
+			return nil, &EnvFileError{File: file, Line: lineNo, Message: err.Error()}
+		}
+
+		envs[key] = value
+	}
+	return envs, nil
+}
+
+func unescapeProperty(s string) (string, error) {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			buf.WriteByte('\t')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'f':
+			buf.WriteByte('\f')
+		case 'u':
+			if i+4 >= len(s) {
+				return "", fmt.Errorf("malformed \\u escape in %q", s)
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("malformed \\u escape in %q", s)
+			}
+			buf.WriteRune(rune(r))
+			i += 4
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String(), nil
+}
+
+func readSourceFiles(files []string, format string) (map[string]string, error) {
+	envs := map[string]string{}
+	lookup := func(name string) (string, bool) {
+		if val, ok := envs[name]; ok {
+			return val, true
+		}
+		return os.LookupEnv(name)
+	}
+
+	for _, file := range files {
+		fileEnvs, err := readEnvFile(file, format, lookup)
+		if err != nil {
+			return envs, err
+		}
+		for key, val := range fileEnvs {
+			envs[key] = val
+		}
+	}
+	return envs, nil
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testLookup(envs map[string]string) envLookup {
+	return func(name string) (string, bool) {
+		val, ok := envs[name]
+		return val, ok
+	}
+}
+
+func TestParseDotEnv(t *testing.T) {
+	lookup := testLookup(map[string]string{"HOME": "/root", "EMPTY": ""})
+
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{"plain", "A=1\nB=two words\n", map[string]string{"A": "1", "B": "two words"}},
+		{"no trailing newline", "A=1", map[string]string{"A": "1"}},
+		{"crlf", "A=1\r\nB=2\r\n", map[string]string{"A": "1", "B": "2"}},
+		{"empty value", "A=\nB=''\nC=\"\"\n", map[string]string{"A": "", "B": "", "C": ""}},
+		{"export prefix", "export A=1\nexport\tB=2\n", map[string]string{"A": "1", "B": "2"}},
+		{"variable named export", "export=1\n", map[string]string{"export": "1"}},
+		{"spaces around =", "A = 1  \n", map[string]string{"A": "1"}},
+		{"dotted key", "app.name=x\n", map[string]string{"app.name": "x"}},
+		{"comments and blank lines", "# comment\n\n  # indented\nA=1 # trailing\n", map[string]string{"A": "1"}},
+		{"hash inside unquoted value", "A=a#b\n", map[string]string{"A": "a#b"}},
+		{"single quoted literal", `A='$HOME \n "x"'`, map[string]string{"A": `$HOME \n "x"`}},
+		{"single quoted comment", "A='x' # c\n", map[string]string{"A": "x"}},
+		{"double quoted escapes", `A="a\tb\nc\"d\\e"`, map[string]string{"A": "a\tb\nc\"d\\e"}},
+		{"double quoted hash", `A="a # b"`, map[string]string{"A": "a # b"}},
+		{"line continuation", "A=\"a\\\nb\"\n", map[string]string{"A": "ab"}},
+		{"multi-line double quoted", "A=\"line1\nline2\"\nB=2\n", map[string]string{"A": "line1\nline2", "B": "2"}},
+		{"multi-line single quoted", "A='line1\nline2'\n", map[string]string{"A": "line1\nline2"}},
+		{"braced variable", "A=${HOME}/x\n", map[string]string{"A": "/root/x"}},
+		{"bare variable", "A=$HOME/x\n", map[string]string{"A": "/root/x"}},
+		{"bare variable stops at dot", "A=$HOME.bak\n", map[string]string{"A": "/root.bak"}},
+		{"unset variable", "A=${NOPE}x\n", map[string]string{"A": "x"}},
+		{"default for unset", "A=${NOPE:-def}\n", map[string]string{"A": "def"}},
+		{"default for empty", "A=${EMPTY:-def}\n", map[string]string{"A": "def"}},
+		{"default not used", "A=${HOME:-def}\n", map[string]string{"A": "/root"}},
+		{"earlier entry", "HOME=/home/app\nA=${HOME}/x\n", map[string]string{"HOME": "/home/app", "A": "/home/app/x"}},
+		{"variable in double quotes", `A="${HOME} x"`, map[string]string{"A": "/root x"}},
+		{"lone dollar", "A=cost $5 $\n", map[string]string{"A": "cost $5 $"}},
+		{"later wins", "A=1\nA=2\n", map[string]string{"A": "2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseDotEnv("test.env", []byte(test.content), lookup)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseDotEnvErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		line    int
+		message string
+	}{
+		{"missing =", "A=1\nB\n", 2, "expected '=' after B"},
+		{"invalid name", "A=1\n\n1A=2\n", 3, "invalid variable name"},
+		{"unterminated single quote", "A=1\nB='x\ny\n", 2, "unterminated single quoted value"},
+		{"unterminated double quote", "A=\"x\n\ny\n", 1, "unterminated double quoted value"},
+		{"text after quoted value", "A='x' y\n", 1, "unexpected character 'y' after value"},
+		{"unterminated reference", "A=1\nB=${A\n", 2, "unterminated variable reference"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseDotEnv("test.env", []byte(test.content), nil)
+			envErr, ok := err.(*EnvFileError)
+			if !ok {
+				t.Fatalf("got %v, want an EnvFileError", err)
+			}
+			if envErr.Line != test.line || !strings.Contains(envErr.Message, test.message) {
+				t.Fatalf("got %q at line %d, want %q at line %d", envErr.Message, envErr.Line, test.message, test.line)
+			}
+			if !strings.HasPrefix(err.Error(), "test.env:") {
+				t.Fatalf("error %q does not name the file", err)
+			}
+		})
+	}
+}
+
+func TestParseProperties(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{"separators", "a=1\nb: 2\nc 3\nd\t=\t4\n", map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}},
+		{"comments", "# one\n! two\n  # three\na=1\n", map[string]string{"a": "1"}},
+		{"key only", "a\n", map[string]string{"a": ""}},
+		{"value with separators", "url=http://host:80/?a=b\n", map[string]string{"url": "http://host:80/?a=b"}},
+		{"escaped separator in key", `a\=b\:c=1`, map[string]string{"a=b:c": "1"}},
+		{"escaped space in key", `a\ b=1`, map[string]string{"a b": "1"}},
+		{"escapes", `a=x\ty\nz\\`, map[string]string{"a": "x\ty\nz\\"}},
+		{"unicode escape", `a=caf\u00e9`, map[string]string{"a": "café"}},
+		{"continuation", "a=one, \\\n    two\nb=3\n", map[string]string{"a": "one, two", "b": "3"}},
+		{"even backslashes do not continue", "a=x\\\\\nb=2\n", map[string]string{"a": `x\`, "b": "2"}},
+		{"crlf", "a=1\r\nb=2\r\n", map[string]string{"a": "1", "b": "2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseProperties("test.properties", []byte(test.content))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParsePropertiesErrors(t *testing.T) {
+	_, err := parseProperties("test.properties", []byte("a=1\nb=\\u12\n"))
+	envErr, ok := err.(*EnvFileError)
+	if !ok || envErr.Line != 2 || !strings.Contains(envErr.Message, `malformed \u escape`) {
+		t.Fatalf("got %v, want a malformed escape error at line 2", err)
+	}
+}
+
+func TestParseJSONAndYAMLEnv(t *testing.T) {
+	want := map[string]string{"name": "app", "port": "8080", "ratio": "0.5", "debug": "true", "empty": ""}
+
+	got, err := parseJSONEnv("test.json", []byte(`{"name": "app", "port": 8080, "ratio": 0.5, "debug": true, "empty": null}`))
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("json: got %q, %v, want %q", got, err, want)
+	}
+
+	got, err = parseYAMLEnv("test.yaml", []byte("name: app\nport: 8080\nratio: 0.5\ndebug: true\nempty:\n"))
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("yaml: got %q, %v, want %q", got, err, want)
+	}
+
+	if _, err := parseJSONEnv("test.json", []byte(`{"a": {"b": 1}}`)); err == nil || !strings.Contains(err.Error(), "value of a is not a scalar") {
+		t.Fatalf("json: got %v, want a not a scalar error", err)
+	}
+	if _, err := parseYAMLEnv("test.yaml", []byte("a: [1, 2]\n")); err == nil || !strings.Contains(err.Error(), "value of a is not a scalar") {
+		t.Fatalf("yaml: got %v, want a not a scalar error", err)
+	}
+
+	// Parsing a cloud-init document first must not change how keys are read.
+	if _, err := NewCloudInitConfig("write-files: []\n"); err != nil {
+		t.Fatal(err)
+	}
+	got, err = parseYAMLEnv("test.yaml", []byte("db-host: a\n"))
+	if err != nil || !reflect.DeepEqual(got, map[string]string{"db-host": "a"}) {
+		t.Fatalf("yaml: got %q, %v, want db-host kept as is", got, err)
+	}
+
+	_, err = parseJSONEnv("test.json", []byte("{\n\"a\": 1,\n}"))
+	if envErr, ok := err.(*EnvFileError); !ok || envErr.Line != 3 {
+		t.Fatalf("json: got %v, want a syntax error at line 3", err)
+	}
+}
+
+func TestReadSourceFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"base.env":         "NAME=app\nURL=http://${NAME}:80\n",
+		"extra.json":       `{"PORT": 8080}`,
+		"extra.yml":        "NAME: override\n",
+		"extra.properties": "path=${NAME}\n",
+	}
+	paths := []string{}
+	for _, name := range []string{"base.env", "extra.json", "extra.yml", "extra.properties"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(files[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	got, err := readSourceFiles(paths, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Properties are not interpolated, and later files override earlier ones.
+	want := map[string]string{"NAME": "override", "URL": "http://app:80", "PORT": "8080", "path": "${NAME}"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// An explicit format applies to every file regardless of its extension.
+	if _, err := readSourceFiles(paths[1:2], "env"); err == nil {
+		t.Fatal("reading JSON as env should fail")
+	}
+	if _, err := readSourceFiles(paths[:1], "toml"); err == nil || !strings.Contains(err.Error(), "Unknown source file format") {
+		t.Fatalf("got %v, want an unknown format error", err)
+	}
+}
@@ -1,10 +1,8 @@
 package app
 
 import (
-	"bufio"
-	"io/ioutil"
+	"fmt"
 	"os"
-	"path"
 	"strings"
 	"syscall"
 	"time"
@@ -21,133 +19,410 @@ func ExecCommand() cli.Command {
 		Name:   "exec",
 		Usage:  "exec out to a command",
 		Action: execCommand,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.BoolFlag{
 				Name:  "secret-envs",
 				Usage: "reads /run/secrets and sets env vars",
 			},
+			cli.StringFlag{
+				Name:  "secrets-dir",
+				Usage: "(Secret envs) directory to read secrets from",
+				Value: "/run/secrets",
+			},
+			cli.StringFlag{
+				Name:  "secrets-prefix",
+				Usage: "(Secret envs) prefix added to every variable name",
+			},
+			cli.BoolFlag{
+				Name:  "secrets-normalize",
+				Usage: "(Secret envs) replace dashes and dots in file names with underscores",
+			},
+			cli.BoolFlag{
+				Name:  "secrets-trim",
+				Usage: "(Secret envs) trim trailing whitespace from values",
+			},
+			cli.BoolFlag{
+				Name:  "secrets-recursive",
+				Usage: "(Secret envs) read subdirectories, joining path components with underscores",
+			},
+			cli.StringSliceFlag{
+				Name:  "secrets-include",
+				Usage: "(Secret envs) only read files matching this glob. Can use the flag multiple times",
+			},
+			cli.StringSliceFlag{
+				Name:  "secrets-exclude",
+				Usage: "(Secret envs) skip files matching this glob. Can use the flag multiple times",
+			},
+			cli.BoolFlag{
+				Name:  "secrets-no-override",
+				Usage: "do not override variables that are already set, applies to --secret-envs and --file-env",
+			},
+			cli.StringSliceFlag{
+				Name:  "file-env",
+				Usage: "read the file named by FOO_FILE into FOO, for the variable FOO or a glob such as DB_*. Can use the flag multiple times",
+			},
+			cli.BoolFlag{
+				Name:  "metadata-envs",
+				Usage: "set RANCHER_* variables from the metadata of this container, its service, stack and host",
+			},
+			cli.StringSliceFlag{
+				Name:  "metadata-label-prefix",
+				Usage: "(Metadata envs) also set RANCHER_LABEL_* variables for container labels with this prefix. Can use the flag multiple times",
+			},
 			cli.BoolFlag{
 				Name:  "cloud-init",
-				Usage: "Process /self/service/metadata/cloud-init (currently only write_files)",
+				Usage: "Process /self/service/metadata/cloud-init (bootcmd, write_files and runcmd)",
 			},
 			cli.StringSliceFlag{
 				Name:  "wait-for-file",
 				Usage: "wait for a file to exist, assumes something else is creating it. This flag can be used more then once for multiple files",
 			},
+			cli.StringSliceFlag{
+				Name:  "wait-for-nonempty",
+				Usage: "wait for a file to exist and be non-empty. Can use the flag multiple times",
+			},
+			cli.StringSliceFlag{
+				Name:  "wait-for-match",
+				Usage: "wait for the content of a file to match a regular expression, as PATH=REGEX. Can use the flag multiple times",
+			},
+			cli.StringSliceFlag{
+				Name:  "wait-for-glob",
+				Usage: "wait for at least COUNT (default 1) files to match a glob, as PATTERN[=COUNT]. Can use the flag multiple times",
+			},
+			cli.StringSliceFlag{
+				Name:  "wait-for-absent",
+				Usage: "wait for a file, such as a lock file, to be removed. Can use the flag multiple times",
+			},
+			cli.StringSliceFlag{
+				Name:  "wait-for-endpoint",
+				Usage: "wait for a tcp://, http(s):// or service://[stack/]service:port endpoint to be healthy. Can use the flag multiple times",
+			},
+			cli.StringFlag{
+				Name:  "wait-endpoint-mode",
+				Usage: "(Wait for endpoint) wait for all endpoints or for any one of them",
+				Value: "all",
+			},
+			cli.DurationFlag{
+				Name:  "wait-endpoint-timeout",
+				Usage: "(Wait for endpoint) timeout of a single check",
+				Value: 5 * time.Second,
+			},
+			cli.DurationFlag{
+				Name:  "wait-timeout",
+				Usage: "fail if the --wait-for-* conditions are not met within this time, 0 waits forever",
+			},
 			cli.StringSliceFlag{
 				Name:  "source-file",
 				Usage: "Source an environment file before executing. Can use the flag multiple times",
 			},
-		},
+			cli.StringFlag{
+				Name:  "source-format",
+				Usage: "format of source files: env, json, yaml, properties or auto to detect from the file extension",
+				Value: "auto",
+			},
+			cli.StringSliceFlag{
+				Name:  "template",
+				Usage: "Render a Go template against metadata before executing, as src:dst. Can use the flag multiple times",
+			},
+			cli.StringFlag{
+				Name:  "template-mode",
+				Usage: "file mode of rendered templates",
+				Value: "0644",
+			},
+			cli.StringFlag{
+				Name:  "template-owner",
+				Usage: "owner of rendered templates, as user, user:group or :group",
+			},
+			cli.StringSliceFlag{
+				Name:  "hook-dir",
+				Usage: "run the executables in a directory in lexical order and source its *.env files before executing. Can use the flag multiple times",
+			},
+			cli.DurationFlag{
+				Name:  "hook-timeout",
+				Usage: "(Hook dir) fail if a single hook runs longer than this, 0 waits forever",
+			},
+			cli.StringFlag{
+				Name:  "user",
+				Usage: "user name or id to run the command as",
+			},
+			cli.StringFlag{
+				Name:  "group",
+				Usage: "group name or id to run the command as, defaults to the primary group of --user",
+			},
+			cli.StringSliceFlag{
+				Name:  "chown",
+				Usage: "recursively change the ownership of a path to --user before dropping privileges. Can use the flag multiple times",
+			},
+			cli.StringFlag{
+				Name:  "umask",
+				Usage: "umask of the command, in octal",
+			},
+			cli.StringFlag{
+				Name:  "workdir",
+				Usage: "working directory of the command",
+			},
+			cli.StringSliceFlag{
+				Name:  "rlimit",
+				Usage: "resource limit as NAME=SOFT[:HARD], e.g. nofile=65536. Can use the flag multiple times",
+			},
+			cli.BoolFlag{
+				Name:  "supervise",
+				Usage: "stay in the foreground as PID 1, forward signals, reap zombies and exit with the command's exit code",
+			},
+			cli.StringSliceFlag{
+				Name:  "signal-map",
+				Usage: "(Supervise) rewrite a signal before forwarding it, e.g. TERM:QUIT. Can use the flag multiple times",
+			},
+			cli.StringFlag{
+				Name:  "pre-stop",
+				Usage: "(Supervise) shell command to run when SIGTERM arrives, before it is forwarded",
+			},
+			cli.DurationFlag{
+				Name:  "grace-period",
+				Usage: "(Supervise) kill the command if it has not exited this long after SIGTERM was forwarded, 0 waits forever",
+			},
+			cli.StringFlag{
+				Name:  "on-exit",
+				Usage: "(Supervise) shell command to run after the command exited, with its exit code in GIDDYUP_EXIT_CODE",
+			},
+		}, cloudInitSourceFlags()...),
 	}
 }
 
-func execCommand(c *cli.Context) error {
-	if c.Bool("secret-envs") {
-		envs, err := filesToMap("/run/secrets")
+// ExecConfig is everything exec does before executing the command. It is
+// read from the exec flags or from a giddyup run config file.
+type ExecConfig struct {
+	MetadataURL   string           `yaml:"metadata_url"`
+	Secrets       SecretsConfig    `yaml:"secrets"`
+	FileEnvs      []string         `yaml:"file_envs"`
+	MetadataEnvs  bool             `yaml:"metadata_envs"`
+	LabelPrefixes []string         `yaml:"metadata_label_prefixes"`
+	CloudInit     CloudInitSources `yaml:"cloud_init"`
+	Wait          WaitConfig       `yaml:"wait"`
+	SourceFiles   []string         `yaml:"source_files"`
+	SourceFormat  string           `yaml:"source_format"`
+	Templates     []string         `yaml:"templates"`
+	TemplateMode  string           `yaml:"template_mode"`
+	TemplateOwner string           `yaml:"template_owner"`
+	HookDirs      []string         `yaml:"hook_dirs"`
+	HookTimeout   string           `yaml:"hook_timeout"`
+	Process       ProcessConfig    `yaml:",inline"`
+	Supervise     bool             `yaml:"supervise"`
+	SignalMap     []string         `yaml:"signal_map"`
+	PreStop       string           `yaml:"pre_stop"`
+	GracePeriod   string           `yaml:"grace_period"`
+	OnExit        string           `yaml:"on_exit"`
+	Command       []string         `yaml:"command"`
+}
+
+func newExecConfig(c *cli.Context) *ExecConfig {
+	return &ExecConfig{
+		MetadataURL:   c.GlobalString("metadata-url"),
+		Secrets:       newSecretsConfig(c),
+		FileEnvs:      c.StringSlice("file-env"),
+		MetadataEnvs:  c.Bool("metadata-envs"),
+		LabelPrefixes: c.StringSlice("metadata-label-prefix"),
+		CloudInit:     newCloudInitSources(c, c.Bool("cloud-init")),
+		Wait:          newWaitConfig(c),
+		SourceFiles:   c.StringSlice("source-file"),
+		SourceFormat:  c.String("source-format"),
+		Templates:     c.StringSlice("template"),
+		TemplateMode:  c.String("template-mode"),
+		TemplateOwner: c.String("template-owner"),
+		HookDirs:      c.StringSlice("hook-dir"),
+		HookTimeout:   c.Duration("hook-timeout").String(),
+		Process:       newProcessConfig(c),
+		Supervise:     c.Bool("supervise"),
+		SignalMap:     c.StringSlice("signal-map"),
+		PreStop:       c.String("pre-stop"),
+		GracePeriod:   c.Duration("grace-period").String(),
+		OnExit:        c.String("on-exit"),
+		Command:       c.Args(),
+	}
+}
+
+func parseDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s %q: %v", name, value, err)
+	}
+	return d, nil
+}
+
+func (e *ExecConfig) supervisorHooks() (SupervisorHooks, error) {
+	gracePeriod, err := parseDuration("grace period", e.GracePeriod)
+	if err != nil {
+		return SupervisorHooks{}, err
+	}
+
+	hooks := SupervisorHooks{
+		PreStop:     e.PreStop,
+		GracePeriod: gracePeriod,
+		OnExit:      e.OnExit,
+	}
+	if !e.Supervise && (hooks.PreStop != "" || hooks.GracePeriod > 0 || hooks.OnExit != "") {
+		return hooks, fmt.Errorf("--pre-stop, --grace-period and --on-exit require --supervise")
+	}
+	return hooks, nil
+}
+
+// run prepares the environment and executes the command. With a plan,
+// steps that only change the environment of giddyup itself still
+// run, everything else is described instead and the command is not
+// executed.
+func (e *ExecConfig) run(plan *execPlan) error {
+	if len(e.Command) == 0 {
+		return fmt.Errorf("No command given")
+	}
+
+	if e.Secrets.Enabled {
+		envs, err := readSecrets(e.Secrets)
 		if err != nil {
 			logrus.Error(err)
 			return err
 		}
 
-		for key, val := range envs {
-			os.Setenv(strings.ToUpper(key), val)
-		}
+		plan.secrets("secrets", e.Secrets.Dir, envs)
+		setEnvs(envs, e.Secrets.NoOverride)
 	}
 
-	if c.Bool("cloud-init") {
-		mdClient, err := metadata.NewClientAndWait(c.GlobalString("metadata-url"))
+	if len(e.FileEnvs) > 0 {
+		envs, fileVars, err := readFileEnvs(e.FileEnvs, e.Secrets)
 		if err != nil {
 			return err
 		}
-		ProcessCloudInit(mdClient)
+
+		plan.secrets("file envs", strings.Join(fileVars, ", "), envs)
+		setEnvs(envs, e.Secrets.NoOverride)
+		for _, fileVar := range fileVars {
+			os.Unsetenv(fileVar)
+		}
 	}
 
-	// This is a fairly naive approach for now.
-	if len(c.StringSlice("wait-for-file")) > 0 {
-		err := waitForFiles(c.StringSlice("wait-for-file"))
+	if e.MetadataEnvs {
+		mdClient, err := metadata.NewClientAndWait(e.MetadataURL)
 		if err != nil {
 			return err
 		}
-	}
 
-	if len(c.StringSlice("source-file")) > 0 {
-		envs, err := readSourceFiles(c.StringSlice("source-file"))
+		envs, err := metadataEnvs(mdClient, e.LabelPrefixes)
 		if err != nil {
 			return err
 		}
+		plan.step("metadata envs: %d variables", len(envs))
+		setEnvs(envs, false)
+	}
 
-		for key, val := range envs {
-			os.Setenv(key, val)
+	if !e.CloudInit.empty() {
+		cloudConfig, err := loadCloudInit(e.MetadataURL, e.CloudInit)
+		if err != nil {
+			return err
+		}
+		if plan != nil {
+			if err := plan.cloudInit(cloudConfig); err != nil {
+				return err
+			}
+		} else if err := cloudConfig.Apply(); err != nil {
+			return err
 		}
 	}
 
-	name, err := exec.LookPath(c.Args().Get(0))
+	waitConditions, err := newWaitConditions(e.Wait)
 	if err != nil {
 		return err
 	}
-
-	return syscall.Exec(name, c.Args(), os.Environ())
-}
-
-func filesToMap(dirPath string) (map[string]string, error) {
-	vals := map[string]string{}
-	files, err := ioutil.ReadDir(dirPath)
+	endpoints, err := newEndpointWait(e.Wait, e.MetadataURL)
 	if err != nil {
-		return vals, err
+		return err
+	}
+	waitTimeout, err := parseDuration("wait timeout", e.Wait.Timeout)
+	if err != nil {
+		return err
+	}
+	if len(waitConditions) > 0 || endpoints != nil {
+		if plan != nil {
+			plan.wait(waitConditions, endpoints, waitTimeout)
+		} else if err := waitForAll(waitConditions, endpoints, waitTimeout); err != nil {
+			return err
+		}
 	}
 
-	for _, file := range files {
-		content, err := ioutil.ReadFile(path.Join(dirPath, file.Name()))
+	if len(e.SourceFiles) > 0 {
+		files := plan.existing("source file", e.SourceFiles)
+		envs, err := readSourceFiles(files, e.SourceFormat)
 		if err != nil {
-			return vals, err
+			return err
+		}
+
+		plan.step("source files: %s", strings.Join(files, ", "))
+		for key, val := range envs {
+			os.Setenv(key, val)
 		}
-		vals[file.Name()] = string(content)
 	}
-	return vals, nil
-}
 
-func waitForFiles(files []string) error {
-	for true {
-		seenCount := 0
-		for idx, file := range files {
-			if file != "seen" {
-				if _, err := os.Stat(file); os.IsNotExist(err) {
-					break
-				}
-				// set the seen value and increment the counter
-				files[idx] = "seen"
-				seenCount++
-
-				continue
+	if len(e.Templates) > 0 {
+		if plan != nil {
+			if err := plan.templates(e.Templates, e.TemplateMode, e.TemplateOwner); err != nil {
+				return err
 			}
-			seenCount++
-		}
-		if seenCount == len(files) {
-			break
+		} else if err := renderTemplates(e.MetadataURL, e.Templates, e.TemplateMode, e.TemplateOwner); err != nil {
+			return err
 		}
-		time.Sleep(1 * time.Second)
 	}
-	return nil
-}
 
-func readSourceFiles(files []string) (map[string]string, error) {
-	envs := map[string]string{}
-	for _, file := range files {
-		// the Close() will not be deferred to avoid large number of open files...
-		f, err := os.Open(file)
+	if len(e.HookDirs) > 0 {
+		hookTimeout, err := parseDuration("hook timeout", e.HookTimeout)
 		if err != nil {
-			return envs, err
+			return err
+		}
+		if err := runHookDirs(e.HookDirs, hookTimeout, plan); err != nil {
+			return err
 		}
+	}
 
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			pair := strings.SplitN(scanner.Text(), "=", 2)
-			if len(pair) == 2 {
-				envs[pair[0]] = pair[1]
-			}
+	var credential *syscall.Credential
+	if plan != nil {
+		if err := plan.process(e.Process); err != nil {
+			return err
+		}
+	} else if credential, err = e.Process.apply(); err != nil {
+		return err
+	}
+
+	signalMap, err := parseSignalMap(e.SignalMap)
+	if err != nil {
+		return err
+	}
+	hooks, err := e.supervisorHooks()
+	if err != nil {
+		return err
+	}
+
+	name, err := exec.LookPath(e.Command[0])
+	if err != nil {
+		return err
+	}
+
+	if plan != nil {
+		return plan.command(name, e.Command, e.Supervise, hooks)
+	}
+
+	if e.Supervise {
+		supervisor := NewSupervisor(e.Command, signalMap, hooks)
+		supervisor.credential = credential
+		code, err := supervisor.Run()
+		if err != nil {
+			return err
 		}
-		f.Close()
+		os.Exit(code)
 	}
-	return envs, nil
+
+	return execAs(name, e.Command, os.Environ(), credential)
+}
+
+func execCommand(c *cli.Context) error {
+	return newExecConfig(c).run(nil)
 }
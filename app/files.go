@@ -1,34 +1,243 @@
 package app
 
 import (
-	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 
-	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos/yaml"
 	"github.com/rancher/os/config/cloudinit/config"
-	"github.com/rancher/os/config/cloudinit/system"
 )
 
-func ProcessCloudInit(mdClient metadata.Client) error {
-	self, err := mdClient.GetSelfService()
+// CloudInitConfig is the part of a #cloud-config document that giddyup
+// applies. bootcmd runs first, then write_files, then runcmd.
+type CloudInitConfig struct {
+	Bootcmd    []interface{}   `yaml:"bootcmd"`
+	WriteFiles []CloudInitFile `yaml:"write_files"`
+	Runcmd     []interface{}   `yaml:"runcmd"`
+}
+
+type CloudInitFile struct {
+	Path        string      `yaml:"path"`
+	Content     string      `yaml:"content"`
+	Encoding    string      `yaml:"encoding"`
+	Owner       string      `yaml:"owner"`
+	Permissions interface{} `yaml:"permissions"`
+	Append      bool        `yaml:"append"`
+}
+
+// CloudInitError points to the directive of a cloud-config document that
+// failed.
+type CloudInitError struct {
+	Directive string
+	Err       error
+}
+
+func (e *CloudInitError) Error() string {
+	return fmt.Sprintf("cloud-init %s: %v", e.Directive, e.Err)
+}
+
+// dashesToUnderscores lets documents use write-files as well as
+// write_files, like RancherOS does.
+func dashesToUnderscores(nameIn string) (nameOut string) {
+	return strings.Replace(nameIn, "-", "_", -1)
+}
+
+// unmarshalYAML decodes content with the given mapping key transform. The
+// transform is a package global of the yaml library, so it is restored
+// afterwards rather than leaking into unrelated documents.
+func unmarshalYAML(content []byte, out interface{}, transform func(string) string) error {
+	saved := yaml.UnmarshalMappingKeyTransform
+	defer func() {
+		yaml.UnmarshalMappingKeyTransform = saved
+	}()
+	yaml.UnmarshalMappingKeyTransform = transform
+	return yaml.Unmarshal(content, out)
+}
+
+func NewCloudInitConfig(contents string) (*CloudInitConfig, error) {
+	cfg := &CloudInitConfig{}
+	err := unmarshalYAML([]byte(contents), cfg, dashesToUnderscores)
+	return cfg, err
+}
+
+// Apply runs bootcmd, writes write_files and runs runcmd, stopping at the
+// first directive that fails.
+func (cc *CloudInitConfig) Apply() error {
+	for i, entry := range cc.Bootcmd {
+		if err := runCloudInitCommand(entry); err != nil {
+			return &CloudInitError{fmt.Sprintf("bootcmd[%d]", i), err}
+		}
+	}
+
+	for i, file := range cc.WriteFiles {
+		if err := file.write(); err != nil {
+			return &CloudInitError{fmt.Sprintf("write_files[%d] (%s)", i, file.Path), err}
+		}
+	}
+
+	for i, entry := range cc.Runcmd {
+		if err := runCloudInitCommand(entry); err != nil {
+			return &CloudInitError{fmt.Sprintf("runcmd[%d]", i), err}
+		}
+	}
+
+	return nil
+}
+
+// cloudInitArgs converts a bootcmd or runcmd entry to an argv. A string is
+// run by the shell, a list is run as is.
+func cloudInitArgs(entry interface{}) ([]string, error) {
+	switch v := entry.(type) {
+	case string:
+		return []string{"/bin/sh", "-c", v}, nil
+	case []interface{}:
+		args := []string{}
+		for _, arg := range v {
+			switch arg.(type) {
+			case map[interface{}]interface{}, []interface{}, nil:
+				return nil, fmt.Errorf("invalid argument %v", arg)
+			}
+			args = append(args, fmt.Sprint(arg))
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("empty command")
+		}
+		return args, nil
+	}
+	return nil, fmt.Errorf("expected a string or a list, got %v", entry)
+}
+
+func runCloudInitCommand(entry interface{}) error {
+	args, err := cloudInitArgs(entry)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Running %q", args)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (f CloudInitFile) mode() (os.FileMode, error) {
+	switch v := f.Permissions.(type) {
+	case nil:
+		return 0644, nil
+	case int:
+		// YAML reads an unquoted 0644 as an octal number already.
+		return os.FileMode(v), nil
+	case string:
+		perm, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid permissions %q", v)
+		}
+		return os.FileMode(perm), nil
+	}
+	return 0, fmt.Errorf("invalid permissions %v", f.Permissions)
+}
+
+func (f CloudInitFile) validate() (os.FileMode, int, int, error) {
+	if f.Path == "" {
+		return 0, -1, -1, fmt.Errorf("path is required")
+	}
+
+	perm, err := f.mode()
+	if err != nil {
+		return 0, -1, -1, err
+	}
+
+	uid, gid, err := parseOwner(f.Owner)
+	if err != nil {
+		return 0, -1, -1, err
+	}
+
+	return perm, uid, gid, nil
+}
+
+func (f CloudInitFile) write() error {
+	perm, uid, gid, err := f.validate()
 	if err != nil {
 		return err
 	}
-	jsonBytes, err := json.Marshal(self.Metadata["cloud-init"])
+
+	content, err := config.DecodeContent(f.Content, f.Encoding)
 	if err != nil {
 		return err
 	}
 
-	cloudConfig, err := config.NewCloudConfig(string(jsonBytes))
+	if !f.Append {
+		logrus.Infof("Writing file to %q", f.Path)
+		return writeFileAtomic(f.Path, content, perm, uid, gid)
+	}
+
+	logrus.Infof("Appending to file %q", f.Path)
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, perm)
 	if err != nil {
 		return err
 	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
 
-	for _, file := range cloudConfig.WriteFiles {
-		_, err := system.WriteFile(&system.File{file}, "/")
-		if err != nil {
+	// Appending keeps the mode of an existing file unless one is given.
+	if f.Permissions != nil {
+		if err := os.Chmod(f.Path, perm); err != nil {
 			return err
 		}
 	}
-
+	if uid != -1 || gid != -1 {
+		return os.Chown(f.Path, uid, gid)
+	}
 	return nil
 }
+
+// writeFileAtomic writes content to a temporary file next to dst and renames
+// it into place, so readers never observe a partially written file. uid and
+// gid of -1 leave the ownership unchanged.
+func writeFileAtomic(dst string, content []byte, mode os.FileMode, uid, gid int) error {
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(dst)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(tmp.Name(), uid, gid); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
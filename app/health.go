@@ -1,10 +1,16 @@
 package app
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -21,81 +27,351 @@ func HealthCommand() cli.Command {
 				Usage: "set port to listen on",
 				Value: 1620,
 			},
+			cli.StringFlag{
+				Name:  "listen-address",
+				Usage: "set address to listen on, all interfaces by default",
+			},
+			cli.StringFlag{
+				Name:  "tls-cert",
+				Usage: "(TLS) serve HTTPS with this certificate",
+			},
+			cli.StringFlag{
+				Name:  "tls-key",
+				Usage: "(TLS) key of the certificate",
+			},
+			cli.StringFlag{
+				Name:  "tls-client-ca",
+				Usage: "(TLS) require client certificates signed by this CA",
+			},
+			cli.StringFlag{
+				Name:   "auth-token",
+				Usage:  "(Auth) require this bearer token",
+				EnvVar: "GIDDYUP_HEALTH_TOKEN",
+			},
+			cli.StringFlag{
+				Name:   "basic-auth",
+				Usage:  "(Auth) require basic auth as USER:PASSWORD",
+				EnvVar: "GIDDYUP_HEALTH_BASIC_AUTH",
+			},
+			cli.StringSliceFlag{
+				Name:  "allow-cidr",
+				Usage: "(Auth) only answer requests from this network. Can use the flag multiple times",
+			},
 			cli.StringFlag{
 				Name:  "check-command",
 				Usage: "command to execute check",
 			},
+			cli.StringSliceFlag{
+				Name:  "check",
+				Usage: "named check as NAME=COMMAND [ARG...]. Can use the flag multiple times",
+			},
+			cli.StringSliceFlag{
+				Name:  "live-check",
+				Usage: "named check that only counts for /live, as NAME=COMMAND [ARG...]. Can use the flag multiple times",
+			},
+			cli.StringSliceFlag{
+				Name:  "ready-check",
+				Usage: "named check that only counts for /ready, as NAME=COMMAND [ARG...]. Can use the flag multiple times",
+			},
+			cli.BoolFlag{
+				Name:  "leader",
+				Usage: "serve /leader, which is healthy only on the leader of the service",
+			},
+			cli.DurationFlag{
+				Name:  "drain-period",
+				Usage: "on SIGTERM, fail /ready for this long before stopping the command and exiting",
+			},
+			cli.StringFlag{
+				Name:  "restart",
+				Usage: "restart policy of the command given as arguments: never, on-failure or always",
+				Value: "never",
+			},
+			cli.DurationFlag{
+				Name:  "restart-delay",
+				Usage: "(Restart) delay before the first restart, doubled on every restart",
+				Value: 1 * time.Second,
+			},
+			cli.DurationFlag{
+				Name:  "restart-max-delay",
+				Usage: "(Restart) maximum delay between restarts",
+				Value: 1 * time.Minute,
+			},
 			cli.StringFlag{
 				Name:  "on-failure-command",
 				Usage: "command to execute if command fails",
 			},
+			cli.DurationFlag{
+				Name:  "interval",
+				Usage: "time between two runs of the check",
+				Value: 2 * time.Second,
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "fail a check that runs longer than this",
+				Value: 1 * time.Minute,
+			},
+			cli.IntFlag{
+				Name:  "healthy-threshold",
+				Usage: "number of consecutive successes before the check is healthy",
+				Value: 1,
+			},
+			cli.IntFlag{
+				Name:  "unhealthy-threshold",
+				Usage: "number of consecutive failures before the check is unhealthy",
+				Value: 1,
+			},
+			cli.DurationFlag{
+				Name:  "failure-cooldown",
+				Usage: "minimum time between two runs of the failure command",
+			},
 		},
 	}
 }
 
 type HealthContext struct {
-	port           string
 	checkCommand   string
 	failureCommand string
+	drainPeriod    time.Duration
+	checks         []*Check
+	child          *childRunner
+	server         *healthServer
+	leader         *leaderState
+
+	draining int32
 }
 
-func NewHealthContext(c *cli.Context) *HealthContext {
+func NewHealthContext(c *cli.Context) (*HealthContext, error) {
 	context := &HealthContext{}
-	context.port = c.String("listen-port")
 	context.checkCommand = c.String("check-command")
 	context.failureCommand = c.String("on-failure-command")
+	context.drainPeriod = c.Duration("drain-period")
+
+	server, err := newHealthServer(c)
+	if err != nil {
+		return nil, err
+	}
+	context.server = server
+
+	if c.Bool("leader") {
+		context.leader = &leaderState{metadataURL: c.GlobalString("metadata-url")}
+	}
+
+	options, err := newCheckOptions(c)
+	if err != nil {
+		return nil, err
+	}
+
+	failure := &failureHook{
+		command:  context.failureCommand,
+		cooldown: c.Duration("failure-cooldown"),
+	}
+
+	if context.checkCommand != "" {
+		context.checks = append(context.checks, NewCheck("check-command", commandProbe([]string{context.checkCommand}), options))
+	}
+
+	names := map[string]bool{}
+	if len(c.Args()) > 0 {
+		policy, err := parseRestartPolicy(c.String("restart"))
+		if err != nil {
+			return nil, err
+		}
+
+		context.child = &childRunner{
+			command:  c.Args(),
+			policy:   policy,
+			minDelay: c.Duration("restart-delay"),
+			maxDelay: c.Duration("restart-max-delay"),
+		}
+		if context.drainPeriod > 0 {
+			context.child.drain = context.drain
+		}
+
+		context.checks = append(context.checks, NewCheck("command", context.child.probe, options))
+		names["command"] = true
+	}
+
+	for scope, flag := range map[checkScope]string{scopeAll: "check", scopeLive: "live-check", scopeReady: "ready-check"} {
+		for _, spec := range c.StringSlice(flag) {
+			check, err := parseCheck(spec, options)
+			if err != nil {
+				return nil, err
+			}
+			if names[check.name] {
+				return nil, fmt.Errorf("Duplicate check %q", check.name)
+			}
+			names[check.name] = true
+			check.scope = scope
+			context.checks = append(context.checks, check)
+		}
+	}
+	sort.SliceStable(context.checks, func(i, j int) bool {
+		return context.checks[i].name < context.checks[j].name
+	})
 
-	return context
+	// A check that only tells whether the app is ready, e.g. still warming
+	// up, is no reason to run the failure command.
+	for _, check := range context.checks {
+		if check.scope.live() {
+			check.onUnhealthy = failure.fire
+		}
+	}
+
+	return context, nil
 }
 
 func simpleHealthCheck(c *cli.Context) error {
-	context := NewHealthContext(c)
-	logrus.Infof("Listening on port: %s", context.port)
+	context, err := NewHealthContext(c)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Listening on %s", context.server.address)
+
+	for _, check := range context.checks {
+		check.Start()
+	}
 
 	http.Handle("/ping", context)
+	http.HandleFunc("/live", context.serveLive)
+	http.HandleFunc("/ready", context.serveReady)
+	http.HandleFunc("/status", context.serveStatus)
+	if context.leader != nil {
+		context.leader.watch()
+		http.Handle("/leader", context.leader)
+	}
 	done := make(chan error)
+	exited := make(chan int)
 
 	go func() {
-		done <- http.ListenAndServe(fmt.Sprintf(":%s", context.port), nil)
+		done <- context.server.listenAndServe(http.DefaultServeMux)
 	}()
 
-	if len(c.Args()) > 0 {
+	if context.child != nil {
 		go func() {
-			done <- runCommand(c.Args()[0], c.Args()[1:]...)
+			exited <- context.child.run()
+		}()
+	} else if context.drainPeriod > 0 {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			context.drain()
+			exited <- 0
 		}()
 	}
 
-	err := <-done
-	if err != nil {
+	select {
+	case err := <-done:
 		logrus.Fatal(err)
+	case code := <-exited:
+		os.Exit(code)
 	}
 	return nil
 }
 
-func (h *HealthContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// drain fails /ready, so that load balancers stop sending new requests,
+// and waits for the drain period to pass.
+func (h *HealthContext) drain() {
+	logrus.Infof("Draining for %v", h.drainPeriod)
+	atomic.StoreInt32(&h.draining, 1)
+	time.Sleep(h.drainPeriod)
+}
+
+func (h *HealthContext) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// respond reports the state of the checks as of their last run. Checks
+// that have not reached a threshold yet count as failed.
+func (h *HealthContext) respond(w http.ResponseWriter, include func(checkScope) bool) {
 	message := "OK"
 	code := http.StatusOK
 
-	if err := runCommand(h.checkCommand); err != nil {
-		code = http.StatusServiceUnavailable
-		message = "Failed Health Check. Attempting to Run: " + h.failureCommand
-		cmdStatus := "....[Success]"
-		if err = runCommand(h.failureCommand); err != nil {
-			cmdStatus = "....[Failed]"
+	for _, check := range h.checks {
+		if !include(check.scope) {
+			continue
+		}
+		if state, err := check.State(); state != checkHealthy {
+			code = http.StatusServiceUnavailable
+			message = fmt.Sprintf("Failed Health Check %s: %v", check.name, state)
+			if err != nil {
+				message += fmt.Sprintf(" (%v)", err)
+			}
+			break
 		}
-		message += cmdStatus
 	}
 
 	w.WriteHeader(code)
 	fmt.Fprintln(w, message)
 }
 
+// ServeHTTP answers /ping, which covers every check.
+func (h *HealthContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.respond(w, func(checkScope) bool { return true })
+}
+
+func (h *HealthContext) serveLive(w http.ResponseWriter, r *http.Request) {
+	h.respond(w, checkScope.live)
+}
+
+func (h *HealthContext) serveReady(w http.ResponseWriter, r *http.Request) {
+	if h.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "Draining")
+		return
+	}
+	h.respond(w, checkScope.ready)
+}
+
+// serveStatus reports every check as JSON, with the same status code as
+// /ping.
+func (h *HealthContext) serveStatus(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		State    checkState             `json:"state"`
+		Live     bool                   `json:"live"`
+		Ready    bool                   `json:"ready"`
+		Draining bool                   `json:"draining"`
+		Leader   *bool                  `json:"leader,omitempty"`
+		Checks   map[string]CheckStatus `json:"checks"`
+	}{
+		State:    checkHealthy,
+		Live:     true,
+		Ready:    !h.isDraining(),
+		Draining: h.isDraining(),
+		Checks:   map[string]CheckStatus{},
+	}
+
+	if h.leader != nil {
+		leader := h.leader.isLeader()
+		status.Leader = &leader
+	}
+
+	for _, check := range h.checks {
+		checkStatus := check.Status()
+		if checkStatus.State != checkHealthy {
+			status.State = checkUnhealthy
+			status.Live = status.Live && !check.scope.live()
+			status.Ready = status.Ready && !check.scope.ready()
+		}
+		status.Checks[check.name] = checkStatus
+	}
+
+	code := http.StatusOK
+	if status.State != checkHealthy {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
 func runCommand(command string, args ...string) error {
 	if command != "" {
 		cmd := exec.Command(command, args...)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		return cmd.Run()
+		return runOwnProcess(cmd)
 	}
 	return nil
 }
@@ -0,0 +1,314 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// maxCheckOutput is how much of the output of a check is kept, from the end.
+const maxCheckOutput = 4096
+
+type checkState int
+
+const (
+	checkUnknown checkState = iota
+	checkHealthy
+	checkUnhealthy
+)
+
+func (s checkState) String() string {
+	switch s {
+	case checkHealthy:
+		return "healthy"
+	case checkUnhealthy:
+		return "unhealthy"
+	}
+	return "unknown"
+}
+
+func (s checkState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// checkOptions mirror the fields of a Rancher metadata.HealthCheck.
+type checkOptions struct {
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+func newCheckOptions(c *cli.Context) (checkOptions, error) {
+	o := checkOptions{
+		interval:           c.Duration("interval"),
+		timeout:            c.Duration("timeout"),
+		healthyThreshold:   c.Int("healthy-threshold"),
+		unhealthyThreshold: c.Int("unhealthy-threshold"),
+	}
+	if o.interval <= 0 || o.timeout <= 0 {
+		return o, fmt.Errorf("--interval and --timeout must be positive")
+	}
+	if o.healthyThreshold < 1 || o.unhealthyThreshold < 1 {
+		return o, fmt.Errorf("--healthy-threshold and --unhealthy-threshold must be at least 1")
+	}
+	return o, nil
+}
+
+// checkScope is which of the health endpoints a check counts for. All
+// checks count for /ping.
+type checkScope string
+
+const (
+	scopeAll   checkScope = "all"
+	scopeLive  checkScope = "live"
+	scopeReady checkScope = "ready"
+)
+
+func (s checkScope) live() bool {
+	return s != scopeReady
+}
+
+func (s checkScope) ready() bool {
+	return s != scopeLive
+}
+
+// probeFunc runs a check once and returns its output.
+type probeFunc func(ctx context.Context) (string, error)
+
+// Check runs a probe on an interval in the background and keeps its state,
+// so that requests to the health server never run a probe themselves. The
+// state only changes after healthyThreshold consecutive successes or
+// unhealthyThreshold consecutive failures.
+type Check struct {
+	name    string
+	scope   checkScope
+	probe   probeFunc
+	options checkOptions
+
+	// onUnhealthy is called when the check turns from healthy to
+	// unhealthy. It must not block, as the check waits for it.
+	onUnhealthy func(c *Check)
+
+	lock           sync.RWMutex
+	state          checkState
+	successes      int
+	failures       int
+	lastErr        error
+	output         string
+	duration       time.Duration
+	lastRun        time.Time
+	lastTransition time.Time
+}
+
+// CheckStatus is the state of a check as reported by /status.
+type CheckStatus struct {
+	Scope               checkScope `json:"scope"`
+	State               checkState `json:"state"`
+	Error               string     `json:"error,omitempty"`
+	Output              string     `json:"output"`
+	DurationSeconds     float64    `json:"duration_seconds"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastRun             *time.Time `json:"last_run,omitempty"`
+	LastTransition      *time.Time `json:"last_transition,omitempty"`
+}
+
+func NewCheck(name string, probe probeFunc, options checkOptions) *Check {
+	return &Check{
+		name:    name,
+		scope:   scopeAll,
+		probe:   probe,
+		options: options,
+	}
+}
+
+// parseCheck reads a NAME=COMMAND [ARG...] or NAME=URL check definition.
+// URLs with the scheme of a native probe are checked in process. Their
+// fragment is passed as written, as url.Parse would decode it before it
+// could be split into options.
+func parseCheck(spec string, options checkOptions) (*Check, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || len(strings.Fields(parts[1])) == 0 {
+		return nil, fmt.Errorf("Invalid check %q, expected NAME=COMMAND or NAME=URL", spec)
+	}
+	name, target := parts[0], strings.TrimSpace(parts[1])
+
+	address, fragment := target, ""
+	if i := strings.Index(target, "#"); i >= 0 {
+		address, fragment = target[:i], target[i+1:]
+	}
+	if u, err := url.Parse(address); err == nil && strings.Contains(address, "://") {
+		if newProbe, ok := nativeProbes[u.Scheme]; ok {
+			u.Fragment = fragment
+			probe, err := newProbe(u)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid check %q: %v", name, err)
+			}
+			return NewCheck(name, probe, options), nil
+		}
+	}
+
+	return NewCheck(name, commandProbe(strings.Fields(target)), options), nil
+}
+
+// commandProbe runs a command and fails if it exits with a non zero status.
+// Its output is captured instead of going to stdout.
+func commandProbe(args []string) probeFunc {
+	return func(ctx context.Context) (string, error) {
+		var output bytes.Buffer
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		err := runOwnProcess(cmd)
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out")
+		}
+		return output.String(), err
+	}
+}
+
+// Start runs the first probe right away and then every interval.
+func (c *Check) Start() {
+	go func() {
+		for {
+			c.run()
+			time.Sleep(c.options.interval)
+		}
+	}()
+}
+
+func (c *Check) run() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.timeout)
+	defer cancel()
+
+	start := time.Now()
+	output, err := c.probe(ctx)
+	duration := time.Since(start)
+	if len(output) > maxCheckOutput {
+		output = output[len(output)-maxCheckOutput:]
+	}
+
+	c.lock.Lock()
+	previous := c.state
+	c.lastErr = err
+	c.output = output
+	c.duration = duration
+	c.lastRun = start
+	if err == nil {
+		c.successes++
+		c.failures = 0
+		if c.successes >= c.options.healthyThreshold {
+			c.state = checkHealthy
+		}
+	} else {
+		c.failures++
+		c.successes = 0
+		if c.failures >= c.options.unhealthyThreshold {
+			c.state = checkUnhealthy
+		}
+	}
+	state := c.state
+	if state != previous {
+		c.lastTransition = time.Now()
+	}
+	c.lock.Unlock()
+
+	if state == previous {
+		return
+	}
+
+	if err != nil {
+		logrus.Warnf("Check %s is %v: %v", c.name, state, err)
+	} else {
+		logrus.Infof("Check %s is %v", c.name, state)
+	}
+	// A check failing from the start has never worked, so there is nothing
+	// for the failure command to bring back.
+	if previous == checkHealthy && state == checkUnhealthy && c.onUnhealthy != nil {
+		c.onUnhealthy(c)
+	}
+}
+
+// State returns the current state and the error of the last probe.
+func (c *Check) State() (checkState, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.state, c.lastErr
+}
+
+// Status returns a snapshot of the check for /status.
+func (c *Check) Status() CheckStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	status := CheckStatus{
+		Scope:               c.scope,
+		State:               c.state,
+		Output:              c.output,
+		DurationSeconds:     c.duration.Seconds(),
+		ConsecutiveFailures: c.failures,
+	}
+	if c.lastErr != nil {
+		status.Error = c.lastErr.Error()
+	}
+	if !c.lastRun.IsZero() {
+		lastRun := c.lastRun
+		status.LastRun = &lastRun
+	}
+	if !c.lastTransition.IsZero() {
+		lastTransition := c.lastTransition
+		status.LastTransition = &lastTransition
+	}
+	return status
+}
+
+// failureHook runs the failure command when a check turns unhealthy, at
+// most once per cooldown and never twice at the same time.
+type failureHook struct {
+	command  string
+	cooldown time.Duration
+
+	lock    sync.Mutex
+	running bool
+	lastRun time.Time
+}
+
+// fire starts the failure command in the background, so that the checks
+// keep running while it does.
+func (f *failureHook) fire(c *Check) {
+	if f.command == "" {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.running {
+		logrus.Infof("Not running failure command for %s, it is still running", c.name)
+		return
+	}
+	if !f.lastRun.IsZero() && time.Since(f.lastRun) < f.cooldown {
+		logrus.Infof("Not running failure command for %s, last run %v ago", c.name, time.Since(f.lastRun))
+		return
+	}
+	f.running = true
+	f.lastRun = time.Now()
+
+	logrus.Infof("Check %s failed, running %s", c.name, f.command)
+	go func() {
+		if err := runCommand(f.command); err != nil {
+			logrus.Errorf("Failure command %s failed: %v", f.command, err)
+		}
+		f.lock.Lock()
+		f.running = false
+		f.lock.Unlock()
+	}()
+}
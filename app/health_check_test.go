@@ -0,0 +1,117 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckThresholds(t *testing.T) {
+	tests := []struct {
+		name string
+		// results are the probe results, + for a success and - for a
+		// failure, and states the state after each of them.
+		results string
+		states  []checkState
+		fired   int
+	}{
+		{"healthy after two successes", "++", []checkState{checkUnknown, checkHealthy}, 0},
+		{"failing from the start", "---", []checkState{checkUnknown, checkUnknown, checkUnhealthy}, 0},
+		{"failures must be consecutive", "++--+--", []checkState{
+			checkUnknown, checkHealthy, checkHealthy, checkHealthy, checkHealthy, checkHealthy, checkHealthy,
+		}, 0},
+		{"turns unhealthy once", "++-----", []checkState{
+			checkUnknown, checkHealthy, checkHealthy, checkHealthy, checkUnhealthy, checkUnhealthy, checkUnhealthy,
+		}, 1},
+		{"recovers and fails again", "++---+++---", []checkState{
+			checkUnknown, checkHealthy, checkHealthy, checkHealthy, checkUnhealthy,
+			checkUnhealthy, checkHealthy, checkHealthy,
+			checkHealthy, checkHealthy, checkUnhealthy,
+		}, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var result error
+			probe := func(ctx context.Context) (string, error) {
+				return "", result
+			}
+			check := NewCheck("test", probe, checkOptions{
+				interval:           time.Second,
+				timeout:            time.Second,
+				healthyThreshold:   2,
+				unhealthyThreshold: 3,
+			})
+			fired := 0
+			check.onUnhealthy = func(c *Check) {
+				fired++
+			}
+
+			for i, r := range test.results {
+				result = nil
+				if r == '-' {
+					result = errors.New("failed")
+				}
+				check.run()
+				if state, _ := check.State(); state != test.states[i] {
+					t.Fatalf("after %s: state is %v, want %v", test.results[:i+1], state, test.states[i])
+				}
+			}
+			if fired != test.fired {
+				t.Fatalf("failure hook ran %d times, want %d", fired, test.fired)
+			}
+		})
+	}
+}
+
+func TestFailureHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	command := filepath.Join(dir, "on-failure")
+	script := "#!/bin/sh\necho run >> " + log + "\nsleep 0.3\necho done >> " + log + "\n"
+	if err := ioutil.WriteFile(command, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	runs := func() string {
+		content, _ := ioutil.ReadFile(log)
+		return string(content)
+	}
+	check := &Check{name: "test"}
+
+	hook := &failureHook{command: command}
+	start := time.Now()
+	hook.fire(check)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("fire blocked for %v", elapsed)
+	}
+	// Still running, so not run again.
+	hook.fire(check)
+	time.Sleep(600 * time.Millisecond)
+	if got := runs(); got != "run\ndone\n" {
+		t.Fatalf("got %q, want a single run", got)
+	}
+	hook.fire(check)
+	time.Sleep(600 * time.Millisecond)
+	if got := strings.Count(runs(), "done"); got != 2 {
+		t.Fatalf("command ran %d times, want 2", got)
+	}
+
+	os.Remove(log)
+	hook = &failureHook{command: command, cooldown: time.Hour}
+	hook.fire(check)
+	time.Sleep(600 * time.Millisecond)
+	hook.fire(check)
+	time.Sleep(100 * time.Millisecond)
+	if got := runs(); got != "run\ndone\n" {
+		t.Fatalf("got %q, want no run within the cooldown", got)
+	}
+}
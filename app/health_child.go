@@ -0,0 +1,140 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// restartStableAfter resets the restart delay for a command that ran at
+// least this long before it exited.
+const restartStableAfter = 10 * time.Second
+
+type restartPolicy string
+
+const (
+	restartNever     restartPolicy = "never"
+	restartOnFailure restartPolicy = "on-failure"
+	restartAlways    restartPolicy = "always"
+)
+
+func parseRestartPolicy(value string) (restartPolicy, error) {
+	switch policy := restartPolicy(value); policy {
+	case restartNever, restartOnFailure, restartAlways:
+		return policy, nil
+	}
+	return "", fmt.Errorf("Invalid restart policy %q, expected never, on-failure or always", value)
+}
+
+func (p restartPolicy) restart(code int) bool {
+	return p == restartAlways || (p == restartOnFailure && code != 0)
+}
+
+// childRunner supervises the command the health server was started with
+// and restarts it according to its policy.
+type childRunner struct {
+	command  []string
+	policy   restartPolicy
+	minDelay time.Duration
+	maxDelay time.Duration
+	drain    func()
+
+	lock     sync.RWMutex
+	running  bool
+	exitCode int
+	restarts int
+}
+
+// probe is the check reporting whether the command is running.
+func (r *childRunner) probe(ctx context.Context) (string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if !r.running {
+		return "", fmt.Errorf("%s exited with code %d, restarted %d times", r.command[0], r.exitCode, r.restarts)
+	}
+	return fmt.Sprintf("%s is running, restarted %d times", r.command[0], r.restarts), nil
+}
+
+func (r *childRunner) setRunning(running bool, code int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.running = running
+	r.exitCode = code
+}
+
+// run supervises the command until the policy says to stop or giddyup is
+// asked to stop, and returns the last exit code.
+func (r *childRunner) run() int {
+	delay := r.minDelay
+
+	// Signals are watched for the whole run, so that one arriving between
+	// two supervisors is not missed.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
+
+	for {
+		supervisor := NewSupervisor(r.command, nil, SupervisorHooks{drain: r.drain})
+		// Nothing else collects orphans when giddyup is PID 1. Check commands
+		// are left to their own cmd.Wait, see runOwnProcess.
+		supervisor.reapOrphans = os.Getpid() == 1
+
+		started := time.Now()
+		r.setRunning(true, 0)
+		code, err := supervisor.Run()
+		if err != nil {
+			logrus.Errorf("Failed to run %s: %v", r.command[0], err)
+		}
+		r.setRunning(false, code)
+
+		if supervisor.Stopping() || !r.policy.restart(code) {
+			return code
+		}
+
+		if time.Since(started) > restartStableAfter {
+			delay = r.minDelay
+		}
+		logrus.Infof("%s exited with code %d, restarting in %v", r.command[0], code, delay)
+		if r.sleep(sigs, delay) {
+			return code
+		}
+
+		r.lock.Lock()
+		r.restarts++
+		r.lock.Unlock()
+
+		delay *= 2
+		if delay > r.maxDelay {
+			delay = r.maxDelay
+		}
+	}
+}
+
+// sleep waits before a restart and reports whether giddyup was asked to
+// stop, before or in the meantime. A signal the supervisor handled arrives
+// here too, but then it reports Stopping and there is no restart.
+func (r *childRunner) sleep(sigs <-chan os.Signal, delay time.Duration) bool {
+	var sig os.Signal
+	select {
+	case sig = <-sigs:
+	default:
+		select {
+		case <-time.After(delay):
+			return false
+		case sig = <-sigs:
+		}
+	}
+
+	logrus.Infof("Received %v, not restarting", sig)
+	if sig == syscall.SIGTERM && r.drain != nil {
+		r.drain()
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestChildRunnerRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runs := filepath.Join(dir, "runs")
+
+	// Fails twice, then succeeds.
+	script := `echo run >> ` + runs + `; [ $(wc -l < ` + runs + `) -ge 3 ]`
+	tests := []struct {
+		policy   restartPolicy
+		code     int
+		restarts int
+	}{
+		{restartNever, 1, 0},
+		{restartOnFailure, 0, 2},
+	}
+	for _, test := range tests {
+		os.Remove(runs)
+		runner := &childRunner{
+			command:  []string{"/bin/sh", "-c", script},
+			policy:   test.policy,
+			minDelay: 10 * time.Millisecond,
+			maxDelay: 20 * time.Millisecond,
+		}
+		if code := runner.run(); code != test.code {
+			t.Errorf("%s: got exit code %d, want %d", test.policy, code, test.code)
+		}
+		if runner.restarts != test.restarts {
+			t.Errorf("%s: restarted %d times, want %d", test.policy, runner.restarts, test.restarts)
+		}
+		if _, err := runner.probe(context.Background()); err == nil {
+			t.Errorf("%s: the command check passes after the command exited", test.policy)
+		}
+	}
+}
+
+func TestChildRunnerStopBeforeRestart(t *testing.T) {
+	drained := 0
+	runner := &childRunner{drain: func() { drained++ }}
+
+	// A signal that arrived before the delay even started must win over a
+	// delay that is over right away.
+	for i := 0; i < 20; i++ {
+		sigs := make(chan os.Signal, 1)
+		sigs <- syscall.SIGTERM
+		if !runner.sleep(sigs, 0) {
+			t.Fatal("restarting despite a pending SIGTERM")
+		}
+	}
+	if drained != 20 {
+		t.Fatalf("drained %d times, want 20", drained)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sigs <- syscall.SIGINT
+	}()
+	if !runner.sleep(sigs, 10*time.Second) {
+		t.Fatal("restarting despite a SIGINT during the delay")
+	}
+	if drained != 20 {
+		t.Fatal("drained after SIGINT")
+	}
+	if runner.sleep(make(chan os.Signal, 1), 10*time.Millisecond) {
+		t.Fatal("not restarting without a signal")
+	}
+}
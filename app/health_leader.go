@@ -0,0 +1,74 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/giddyup/election"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	leaderUnknown int32 = iota
+	leaderYes
+	leaderNo
+)
+
+// leaderState tracks whether this container is the leader of its service.
+// It is refreshed when metadata changes, so /leader never queries metadata
+// itself.
+type leaderState struct {
+	metadataURL string
+	state       int32
+}
+
+// watch connects to metadata in the background, so that the health server
+// starts even if metadata is not reachable yet.
+func (l *leaderState) watch() {
+	go func() {
+		client, err := metadata.NewClientAndWait(l.metadataURL)
+		if err != nil {
+			logrus.Errorf("Failed to connect to metadata for leader election: %v", err)
+			return
+		}
+
+		w := election.New(client, 0, nil)
+		client.OnChange(2, func(version string) {
+			l.update(w.IsLeader())
+		})
+	}()
+}
+
+func (l *leaderState) update(leader bool) {
+	state := leaderNo
+	if leader {
+		state = leaderYes
+	}
+	if previous := atomic.SwapInt32(&l.state, state); previous != state {
+		if leader {
+			logrus.Info("This container is now the leader")
+		} else {
+			logrus.Info("This container is not the leader")
+		}
+	}
+}
+
+func (l *leaderState) isLeader() bool {
+	return atomic.LoadInt32(&l.state) == leaderYes
+}
+
+func (l *leaderState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch atomic.LoadInt32(&l.state) {
+	case leaderYes:
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "Leader")
+	case leaderNo:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "Not leader")
+	default:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "Leader unknown")
+	}
+}
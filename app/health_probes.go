@@ -0,0 +1,250 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// nativeProbes build probes that run in process, for images that have no
+// shell, curl or nc to run a check command with.
+var nativeProbes = map[string]func(u *url.URL) (probeFunc, error){
+	"tcp":     tcpProbe,
+	"http":    httpProbe,
+	"https":   httpProbe,
+	"file":    fileProbe,
+	"pidfile": pidfileProbe,
+	"disk":    diskProbe,
+}
+
+// checkTimeout is the time left for a probe to run.
+func checkTimeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return 0
+}
+
+// localPath returns the path of a file://, pidfile:// or disk:// URL. Both
+// scheme:///abs/path and scheme://rel/path are accepted.
+func localPath(u *url.URL) string {
+	return u.Host + u.Path
+}
+
+// unescapeParam decodes the %XX escapes of a query or fragment value. A +
+// is kept, not turned into a space, as it is more often part of a regular
+// expression or of a reply such as +PONG. Values that are not valid escapes
+// are kept as they are, so that min-free=10% does not need to be written as
+// 10%25. A # starts the fragment and an & the next parameter, so they must
+// be written as %23 and %26.
+func unescapeParam(value string) string {
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		return unescaped
+	}
+	return value
+}
+
+// splitParams splits a raw query or fragment into its parameters, in order.
+func splitParams(raw string) [][2]string {
+	params := [][2]string{}
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		params = append(params, [2]string{parts[0], unescapeParam(parts[1])})
+	}
+	return params
+}
+
+// queryParam returns the first query parameter key of u, decoded with
+// unescapeParam.
+func queryParam(u *url.URL, key string) string {
+	for _, param := range splitParams(u.RawQuery) {
+		if param[0] == key {
+			return param[1]
+		}
+	}
+	return ""
+}
+
+func tcpProbe(u *url.URL) (probeFunc, error) {
+	endpoint := u.String()
+	return func(ctx context.Context) (string, error) {
+		if err := healthCheck(endpoint, newProbeOptions(checkTimeout(ctx))); err != nil {
+			return "", err
+		}
+		return "connected to " + u.Host, nil
+	}, nil
+}
+
+// httpProbe checks a URL whose fragment holds the expectations, e.g.
+// http://localhost/health#status=200,204&body=ok. The fragment is not sent.
+// It is still escaped, see parseCheck, and its values are decoded like
+// those of the query.
+func httpProbe(u *url.URL) (probeFunc, error) {
+	expect := defaultHTTPExpectation
+
+	var err error
+	for _, param := range splitParams(u.Fragment) {
+		key, value := param[0], param[1]
+		switch key {
+		case "status":
+			if expect.status, err = parseStatusRanges(value); err != nil {
+				return nil, err
+			}
+		case "body":
+			if expect.body, err = regexp.Compile(value); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("Unknown HTTP check option %q", key)
+		}
+	}
+
+	target := *u
+	target.Fragment = ""
+	endpoint := target.String()
+
+	return func(ctx context.Context) (string, error) {
+		options := newProbeOptions(checkTimeout(ctx))
+		options.expect = expect
+		return httpCheck(endpoint, options)
+	}, nil
+}
+
+// fileProbe checks that a file exists and, with max-age, that it was
+// modified recently, e.g. file:///tmp/heartbeat?max-age=30s.
+func fileProbe(u *url.URL) (probeFunc, error) {
+	path := localPath(u)
+
+	var maxAge time.Duration
+	if value := queryParam(u, "max-age"); value != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("Invalid max-age %q: %v", value, err)
+		}
+	}
+
+	return func(ctx context.Context) (string, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+
+		// Whole seconds are enough to read, and Duration.Round needs Go 1.9.
+		age := time.Duration(time.Since(info.ModTime()).Seconds()) * time.Second
+		if maxAge > 0 && age > maxAge {
+			return "", fmt.Errorf("%s was modified %v ago, more than %v", path, age, maxAge)
+		}
+		return fmt.Sprintf("%s was modified %v ago", path, age), nil
+	}, nil
+}
+
+// pidfileProbe checks that the process whose pid is in a file is running.
+func pidfileProbe(u *url.URL) (probeFunc, error) {
+	path := localPath(u)
+
+	return func(ctx context.Context) (string, error) {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil || pid <= 0 {
+			return "", fmt.Errorf("%s does not contain a pid", path)
+		}
+
+		// EPERM means the process exists but belongs to another user.
+		if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+			return "", fmt.Errorf("pid %d from %s is not running", pid, path)
+		}
+		return fmt.Sprintf("pid %d is running", pid), nil
+	}, nil
+}
+
+// parseSize reads a size in bytes with an optional binary unit, such as
+// 512M, 1GiB or 2T.
+func parseSize(value string) (uint64, error) {
+	units := map[string]uint64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+	number := strings.TrimRight(value, "KMGTiB")
+	unit := strings.TrimSuffix(strings.TrimSuffix(value[len(number):], "B"), "i")
+	multiplier, ok := units[unit]
+	if !ok {
+		return 0, fmt.Errorf("Invalid size %q", value)
+	}
+
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Invalid size %q", value)
+	}
+	return uint64(size * float64(multiplier)), nil
+}
+
+func formatSize(size uint64) string {
+	value := float64(size)
+	for _, unit := range []string{"B", "KiB", "MiB", "GiB"} {
+		if value < 1024 {
+			return fmt.Sprintf("%.1f%s", value, unit)
+		}
+		value /= 1024
+	}
+	return fmt.Sprintf("%.1fTiB", value)
+}
+
+// diskProbe checks the free space of the file system holding a path, as
+// an absolute size or a percentage, e.g. disk:///data?min-free=10%.
+func diskProbe(u *url.URL) (probeFunc, error) {
+	path := localPath(u)
+
+	value := queryParam(u, "min-free")
+	if value == "" {
+		return nil, fmt.Errorf("disk check %s needs min-free", u)
+	}
+
+	var (
+		minFree    uint64
+		minPercent float64
+		err        error
+	)
+	if strings.HasSuffix(value, "%") {
+		minPercent, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || minPercent < 0 || minPercent > 100 {
+			return nil, fmt.Errorf("Invalid min-free %q", value)
+		}
+	} else if minFree, err = parseSize(value); err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context) (string, error) {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(path, &stat); err != nil {
+			return "", err
+		}
+
+		free := stat.Bavail * uint64(stat.Bsize)
+		total := stat.Blocks * uint64(stat.Bsize)
+		percent := 0.0
+		if total > 0 {
+			percent = float64(free) * 100 / float64(total)
+		}
+
+		message := fmt.Sprintf("%s free on %s (%.1f%%)", formatSize(free), path, percent)
+		if free < minFree || percent < minPercent {
+			return "", fmt.Errorf("only %s, need %s", message, value)
+		}
+		return message, nil
+	}, nil
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryParam(t *testing.T) {
+	tests := []struct {
+		query, key, want string
+	}{
+		{"expect=^\\+PONG", "expect", "^\\+PONG"},
+		{"expect=a+b", "expect", "a+b"},
+		{"expect=%23%20ok%26", "expect", "# ok&"},
+		{"min-free=10%", "min-free", "10%"},
+		{"send=a&send=b", "send", "a"},
+		{"send&expect=x", "send", ""},
+		{"other=x", "send", ""},
+	}
+	for _, test := range tests {
+		u := &url.URL{Scheme: "tcp", Host: "localhost", RawQuery: test.query}
+		if got := queryParam(u, test.key); got != test.want {
+			t.Errorf("%s: %s is %q, want %q", test.query, test.key, got, test.want)
+		}
+	}
+}
+
+func TestHTTPProbeFragment(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || r.URL.RawQuery != "q=1" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("a+b #1 & 50% ok"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		fragment string
+		wantErr  string
+	}{
+		{"", ""},
+		{"status=200&body=^a\\+b %231 %26 50%25 ok$", ""},
+		{"body=a+b", `does not match "a+b"`},
+		{"body=%2520", `does not match "%20"`},
+		{"status=204", "expected status 204"},
+		{"status=200&status=500", "expected status 500"},
+		{"timeout=1s", "Unknown HTTP check option"},
+		{"body=(", "error parsing regexp"},
+	}
+	for _, test := range tests {
+		spec := "web=" + server.URL + "/health?q=1#" + test.fragment
+		check, err := parseCheck(spec, checkOptions{interval: time.Second, timeout: time.Second})
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			_, err = check.probe(ctx)
+			cancel()
+		}
+		if test.wantErr == "" && err != nil || test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: got %v, want %q", test.fragment, err, test.wantErr)
+		}
+	}
+}
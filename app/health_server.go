@@ -0,0 +1,167 @@
+package app
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// healthServer holds how the health server listens and who may query it.
+type healthServer struct {
+	address  string
+	tlsCert  string
+	tlsKey   string
+	clientCA string
+
+	token       string
+	basicUser   string
+	basicPass   string
+	allowedNets []*net.IPNet
+}
+
+func newHealthServer(c *cli.Context) (*healthServer, error) {
+	s := &healthServer{
+		address:  net.JoinHostPort(c.String("listen-address"), c.String("listen-port")),
+		tlsCert:  c.String("tls-cert"),
+		tlsKey:   c.String("tls-key"),
+		clientCA: c.String("tls-client-ca"),
+		token:    c.String("auth-token"),
+	}
+
+	if (s.tlsCert == "") != (s.tlsKey == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key must be used together")
+	}
+	if s.clientCA != "" && s.tlsCert == "" {
+		return nil, fmt.Errorf("--tls-client-ca requires --tls-cert and --tls-key")
+	}
+
+	if basic := c.String("basic-auth"); basic != "" {
+		parts := strings.SplitN(basic, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid --basic-auth, expected USER:PASSWORD")
+		}
+		s.basicUser, s.basicPass = parts[0], parts[1]
+	}
+	if s.token != "" && s.basicUser != "" {
+		return nil, fmt.Errorf("--auth-token and --basic-auth can not be used together")
+	}
+
+	for _, value := range c.StringSlice("allow-cidr") {
+		cidr := value
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --allow-cidr %q", value)
+		}
+		s.allowedNets = append(s.allowedNets, ipNet)
+	}
+	return s, nil
+}
+
+// allowed reports whether a request comes from one of the allowed networks.
+func (s *healthServer) allowed(r *http.Request) bool {
+	if len(s.allowedNets) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, ipNet := range s.allowedNets {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticated checks the bearer token or basic auth credentials of a
+// request, in constant time.
+func (s *healthServer) authenticated(r *http.Request) bool {
+	switch {
+	case s.token != "":
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(s.token)) == 1
+	case s.basicUser != "":
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			return false
+		}
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.basicUser)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.basicPass)) == 1
+		return userOK && passOK
+	}
+	return true
+}
+
+// protect rejects requests from outside the allowed networks or without
+// valid credentials before they reach a handler.
+func (s *healthServer) protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowed(r) {
+			logrus.Warnf("Rejected health request from %s", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !s.authenticated(r) {
+			if s.basicUser != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="giddyup"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenAndServe serves handler over HTTP, or HTTPS if a certificate was
+// given, optionally requiring clients to present a certificate signed by
+// the client CA.
+func (s *healthServer) listenAndServe(handler http.Handler) error {
+	server := &http.Server{
+		Addr:    s.address,
+		Handler: s.protect(handler),
+	}
+
+	if s.tlsCert == "" {
+		return server.ListenAndServe()
+	}
+
+	if s.clientCA != "" {
+		pem, err := ioutil.ReadFile(s.clientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in %s", s.clientCA)
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+
+	return server.ListenAndServeTLS(s.tlsCert, s.tlsKey)
+}
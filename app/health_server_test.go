@@ -0,0 +1,144 @@
+package app
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// newTestHealthServer reads the server options from the health flags in
+// args.
+func newTestHealthServer(args ...string) (*healthServer, error) {
+	var (
+		server *healthServer
+		err    error
+	)
+	app := cli.NewApp()
+	app.Flags = HealthCommand().Flags
+	app.Action = func(c *cli.Context) error {
+		server, err = newHealthServer(c)
+		return nil
+	}
+	if runErr := app.Run(append([]string{"giddyup"}, args...)); runErr != nil {
+		return nil, runErr
+	}
+	return server, err
+}
+
+func TestNewHealthServer(t *testing.T) {
+	tests := []struct {
+		args    []string
+		address string
+		wantErr string
+	}{
+		{nil, ":1620", ""},
+		{[]string{"--listen-address", "127.0.0.1", "-p", "8080"}, "127.0.0.1:8080", ""},
+		{[]string{"--listen-address", "::1"}, "[::1]:1620", ""},
+		{[]string{"--allow-cidr", "10.0.0.1", "--allow-cidr", "fd00::/8"}, ":1620", ""},
+		{[]string{"--allow-cidr", "nope"}, "", `Invalid --allow-cidr "nope"`},
+		{[]string{"--allow-cidr", "10.0.0.0/33"}, "", `Invalid --allow-cidr "10.0.0.0/33"`},
+		{[]string{"--basic-auth", "user"}, "", "Invalid --basic-auth"},
+		{[]string{"--basic-auth", "user:pass", "--auth-token", "x"}, "", "can not be used together"},
+		{[]string{"--tls-cert", "cert.pem"}, "", "--tls-cert and --tls-key must be used together"},
+		{[]string{"--tls-client-ca", "ca.pem"}, "", "--tls-client-ca requires"},
+	}
+	for _, test := range tests {
+		server, err := newTestHealthServer(test.args...)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%q: got %v, want %q", test.args, err, test.wantErr)
+			}
+			// The error must show the value as given, not as completed.
+			if err != nil && strings.Contains(err.Error(), "/128") {
+				t.Errorf("%q: error %q shows a suffix that was not given", test.args, err)
+			}
+			continue
+		}
+		if err != nil || server.address != test.address {
+			t.Errorf("%q: got %v, want address %q", test.args, err, test.address)
+		}
+	}
+}
+
+func TestHealthServerProtect(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		remoteAddr string
+		header     string
+		code       int
+		challenge  string
+	}{
+		{"open", nil, "192.0.2.1:1234", "", http.StatusOK, ""},
+		{"token missing", []string{"--auth-token", "s3cret"}, "192.0.2.1:1234", "", http.StatusUnauthorized, "Bearer"},
+		{"token wrong", []string{"--auth-token", "s3cret"}, "192.0.2.1:1234", "Bearer wrong", http.StatusUnauthorized, "Bearer"},
+		{"token not bearer", []string{"--auth-token", "s3cret"}, "192.0.2.1:1234", "s3cret", http.StatusUnauthorized, "Bearer"},
+		{"token", []string{"--auth-token", "s3cret"}, "192.0.2.1:1234", "Bearer s3cret", http.StatusOK, ""},
+		{"basic missing", []string{"--basic-auth", "user:pass"}, "192.0.2.1:1234", "", http.StatusUnauthorized, `Basic realm="giddyup"`},
+		{"basic wrong", []string{"--basic-auth", "user:pass"}, "192.0.2.1:1234", "Basic dXNlcjp3cm9uZw==", http.StatusUnauthorized, `Basic realm="giddyup"`},
+		{"basic", []string{"--basic-auth", "user:pass"}, "192.0.2.1:1234", "Basic dXNlcjpwYXNz", http.StatusOK, ""},
+		{"cidr", []string{"--allow-cidr", "10.0.0.0/8"}, "10.1.2.3:1234", "", http.StatusOK, ""},
+		{"cidr outside", []string{"--allow-cidr", "10.0.0.0/8"}, "192.0.2.1:1234", "", http.StatusForbidden, ""},
+		{"single address", []string{"--allow-cidr", "10.0.0.1"}, "10.0.0.2:1234", "", http.StatusForbidden, ""},
+		{"ipv6 cidr", []string{"--allow-cidr", "fd00::/8"}, "[fd00::1]:1234", "", http.StatusOK, ""},
+		{"ipv6 outside", []string{"--allow-cidr", "fd00::/8"}, "[2001:db8::1]:1234", "", http.StatusForbidden, ""},
+		{"ipv6 single address", []string{"--allow-cidr", "::1"}, "[::1]:1234", "", http.StatusOK, ""},
+		{"cidr before auth", []string{"--allow-cidr", "10.0.0.0/8", "--auth-token", "s3cret"}, "192.0.2.1:1234", "Bearer s3cret", http.StatusForbidden, ""},
+		{"cidr and auth", []string{"--allow-cidr", "10.0.0.0/8", "--auth-token", "s3cret"}, "10.1.2.3:1234", "", http.StatusUnauthorized, "Bearer"},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	for _, test := range tests {
+		server, err := newTestHealthServer(test.args...)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		request := httptest.NewRequest("GET", "/ping", nil)
+		request.RemoteAddr = test.remoteAddr
+		if test.header != "" {
+			request.Header.Set("Authorization", test.header)
+		}
+		recorder := httptest.NewRecorder()
+		server.protect(ok).ServeHTTP(recorder, request)
+
+		if recorder.Code != test.code {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.code)
+		}
+		if challenge := recorder.Header().Get("WWW-Authenticate"); challenge != test.challenge {
+			t.Errorf("%s: got WWW-Authenticate %q, want %q", test.name, challenge, test.challenge)
+		}
+	}
+}
+
+func TestHealthServerIPv6(t *testing.T) {
+	server, err := newTestHealthServer("--listen-address", "::1", "-p", "0", "--allow-cidr", "::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", server.address)
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, server.protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})))
+
+	response, err := http.Get("http://" + listener.Addr().String() + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Fatalf("got %d %q, want 200 OK", response.StatusCode, body)
+	}
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// HookError reports the hook that stopped the entrypoint.
+type HookError struct {
+	Hook     string
+	ExitCode int
+	Err      error
+}
+
+func (e *HookError) Error() string {
+	if e.ExitCode > 0 {
+		return fmt.Sprintf("Hook %s failed with exit code %d", e.Hook, e.ExitCode)
+	}
+	return fmt.Sprintf("Hook %s failed: %v", e.Hook, e.Err)
+}
+
+// runHookDirs runs every executable in the directories in lexical order.
+// Files ending in .env are sourced into the environment of the hooks that
+// follow and of the command. A timeout of 0 lets hooks run forever. With a
+// plan, hooks are listed instead of run.
+func runHookDirs(dirs []string, timeout time.Duration, plan *execPlan) error {
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			hook := filepath.Join(dir, entry.Name())
+
+			switch {
+			case entry.IsDir():
+				logrus.Debugf("Ignoring directory %s", hook)
+			case strings.HasSuffix(entry.Name(), ".env"):
+				logrus.Infof("Sourcing %s", hook)
+				plan.step("hook: source %s", hook)
+				envs, err := readEnvFile(hook, "env", os.LookupEnv)
+				if err != nil {
+					return &HookError{Hook: hook, Err: err}
+				}
+				setEnvs(envs, false)
+			case entry.Mode()&0111 != 0 && plan != nil:
+				plan.step("hook: run %s", hook)
+			case entry.Mode()&0111 != 0:
+				if err := runHook(hook, timeout); err != nil {
+					return err
+				}
+			default:
+				logrus.Debugf("Ignoring %s, not executable", hook)
+			}
+		}
+	}
+	return nil
+}
+
+func runHook(hook string, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	logrus.Infof("Running %s", hook)
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return &HookError{Hook: hook, Err: fmt.Errorf("timed out after %v", timeout)}
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return &HookError{Hook: hook, ExitCode: exitCode(status), Err: err}
+		}
+	}
+	if err != nil {
+		return &HookError{Hook: hook, Err: err}
+	}
+	return nil
+}
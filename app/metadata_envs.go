@@ -0,0 +1,118 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	metadataEnvPrefix = "RANCHER_METADATA_"
+	labelEnvPrefix    = "RANCHER_LABEL_"
+)
+
+// upperSnake converts a key such as maxConnections, db-host or db.host to
+// MAX_CONNECTIONS, DB_HOST and DB_HOST.
+func upperSnake(key string) string {
+	runes := []rune(key)
+	out := []rune{}
+	for i, r := range runes {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+				out = append(out, '_')
+			}
+			out = append(out, unicode.ToUpper(r))
+		case len(out) > 0 && out[len(out)-1] != '_':
+			out = append(out, '_')
+		}
+	}
+	return strings.Trim(string(out), "_")
+}
+
+// flattenMetadata turns nested maps and lists into one variable per leaf,
+// joining the path with underscores. List elements are named by index.
+func flattenMetadata(prefix string, value interface{}, envs map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flattenMetadata(prefix+"_"+upperSnake(key), child, envs)
+		}
+	case map[interface{}]interface{}:
+		for key, child := range v {
+			flattenMetadata(prefix+"_"+upperSnake(fmt.Sprint(key)), child, envs)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenMetadata(prefix+"_"+strconv.Itoa(i), child, envs)
+		}
+	case nil:
+		envs[prefix] = ""
+	case float64:
+		envs[prefix] = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		envs[prefix] = fmt.Sprint(v)
+	}
+}
+
+// metadataEnvs returns the RANCHER_* variables describing this container,
+// its service, stack and host, the service's user defined metadata and the
+// container labels starting with one of labelPrefixes.
+func metadataEnvs(mdClient metadata.Client, labelPrefixes []string) (map[string]string, error) {
+	container, err := mdClient.GetSelfContainer()
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := mdClient.GetSelfHost()
+	if err != nil {
+		return nil, err
+	}
+
+	envs := map[string]string{
+		"RANCHER_CONTAINER_NAME": container.Name,
+		"RANCHER_CONTAINER_UUID": container.UUID,
+		"RANCHER_CONTAINER_IP":   container.PrimaryIp,
+		"RANCHER_SERVICE_NAME":   container.ServiceName,
+		"RANCHER_SERVICE_INDEX":  container.ServiceIndex,
+		"RANCHER_CREATE_INDEX":   strconv.Itoa(container.CreateIndex),
+		"RANCHER_STACK_NAME":     container.StackName,
+		"RANCHER_HOST_NAME":      host.Hostname,
+		"RANCHER_HOST_UUID":      host.UUID,
+		"RANCHER_HOST_AGENT_IP":  host.AgentIP,
+	}
+
+	if container.ServiceName != "" {
+		service, err := mdClient.GetSelfService()
+		if err != nil {
+			return nil, err
+		}
+		envs["RANCHER_SERVICE_SCALE"] = strconv.Itoa(service.Scale)
+
+		for key, value := range service.Metadata {
+			flattenMetadata(metadataEnvPrefix+upperSnake(key), value, envs)
+		}
+	}
+
+	// Sorted so that labels mapping to the same name resolve predictably.
+	labels := make([]string, 0, len(container.Labels))
+	for label := range container.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		for _, prefix := range labelPrefixes {
+			if strings.HasPrefix(label, prefix) {
+				envs[labelEnvPrefix+upperSnake(strings.TrimPrefix(label, prefix))] = container.Labels[label]
+				break
+			}
+		}
+	}
+
+	return envs, nil
+}
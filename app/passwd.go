@@ -0,0 +1,152 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+)
+
+type passwdEntry struct {
+	name string
+	uid  int
+	gid  int
+	home string
+}
+
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// lookupUser finds a user by name or numeric id in the container's
+// /etc/passwd. A numeric id that has no entry is returned as-is.
+func lookupUser(name string) (passwdEntry, error) {
+	id, idErr := strconv.Atoi(name)
+
+	var found *passwdEntry
+	err := scanColonFile(passwdFile, func(fields []string) bool {
+		if len(fields) < 6 {
+			return false
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return false
+		}
+		if fields[0] != name && (idErr != nil || uid != id) {
+			return false
+		}
+		gid, _ := strconv.Atoi(fields[3])
+		found = &passwdEntry{name: fields[0], uid: uid, gid: gid, home: fields[5]}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return passwdEntry{}, err
+	}
+
+	switch {
+	case found != nil:
+		return *found, nil
+	case idErr == nil:
+		return passwdEntry{name: name, uid: id, gid: id, home: "/"}, nil
+	default:
+		return passwdEntry{}, fmt.Errorf("Unknown user: %s", name)
+	}
+}
+
+// lookupGroup finds a group by name or numeric id in the container's
+// /etc/group. A numeric id that has no entry is returned as-is.
+func lookupGroup(name string) (groupEntry, error) {
+	id, idErr := strconv.Atoi(name)
+
+	var found *groupEntry
+	err := scanColonFile(groupFile, func(fields []string) bool {
+		if len(fields) < 4 {
+			return false
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return false
+		}
+		if fields[0] != name && (idErr != nil || gid != id) {
+			return false
+		}
+		found = &groupEntry{name: fields[0], gid: gid, members: splitMembers(fields[3])}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return groupEntry{}, err
+	}
+
+	switch {
+	case found != nil:
+		return *found, nil
+	case idErr == nil:
+		return groupEntry{name: name, gid: id}, nil
+	default:
+		return groupEntry{}, fmt.Errorf("Unknown group: %s", name)
+	}
+}
+
+// parseOwner resolves an owner in chown syntax (user, user:group or :group)
+// to numeric ids. An id that is not set is returned as -1.
+func parseOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+
+	parts := strings.SplitN(owner, ":", 2)
+	if parts[0] != "" {
+		user, err := lookupUser(parts[0])
+		if err != nil {
+			return uid, gid, err
+		}
+		uid = user.uid
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		group, err := lookupGroup(parts[1])
+		if err != nil {
+			return uid, gid, err
+		}
+		gid = group.gid
+	}
+	return uid, gid, nil
+}
+
+func scanColonFile(file string, match func([]string) bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if match(strings.Split(line, ":")) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func splitMembers(list string) []string {
+	members := []string{}
+	for _, member := range strings.Split(list, ",") {
+		if member = strings.TrimSpace(member); member != "" {
+			members = append(members, member)
+		}
+	}
+	return members
+}
@@ -0,0 +1,258 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	rlimitNproc   = 0x6
+	rlimitMemlock = 0x8
+	rlimitUnset   = ^uint64(0)
+)
+
+var rlimitNames = map[string]int{
+	"as":      syscall.RLIMIT_AS,
+	"core":    syscall.RLIMIT_CORE,
+	"cpu":     syscall.RLIMIT_CPU,
+	"data":    syscall.RLIMIT_DATA,
+	"fsize":   syscall.RLIMIT_FSIZE,
+	"memlock": rlimitMemlock,
+	"nofile":  syscall.RLIMIT_NOFILE,
+	"nproc":   rlimitNproc,
+	"stack":   syscall.RLIMIT_STACK,
+}
+
+// ProcessConfig describes the process the command is executed as.
+type ProcessConfig struct {
+	User    string   `yaml:"user"`
+	Group   string   `yaml:"group"`
+	Chown   []string `yaml:"chown"`
+	Umask   string   `yaml:"umask"`
+	Workdir string   `yaml:"workdir"`
+	Rlimits []string `yaml:"rlimits"`
+}
+
+func newProcessConfig(c *cli.Context) ProcessConfig {
+	return ProcessConfig{
+		User:    c.String("user"),
+		Group:   c.String("group"),
+		Chown:   c.StringSlice("chown"),
+		Umask:   c.String("umask"),
+		Workdir: c.String("workdir"),
+		Rlimits: c.StringSlice("rlimit"),
+	}
+}
+
+// credentials resolves the user and group to switch to, including the
+// supplementary groups the user is a member of in /etc/group.
+func (p ProcessConfig) credentials() (passwdEntry, []int, error) {
+	user, err := lookupUser(p.User)
+	if err != nil {
+		return user, nil, err
+	}
+
+	if p.Group != "" {
+		group, err := lookupGroup(p.Group)
+		if err != nil {
+			return user, nil, err
+		}
+		user.gid = group.gid
+	}
+
+	groups := []int{user.gid}
+	err = scanColonFile(groupFile, func(fields []string) bool {
+		if len(fields) < 4 {
+			return false
+		}
+		for _, member := range splitMembers(fields[3]) {
+			if member == user.name {
+				if gid, err := strconv.Atoi(fields[2]); err == nil && gid != user.gid {
+					groups = append(groups, gid)
+				}
+			}
+		}
+		return false
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return user, nil, err
+	}
+
+	return user, groups, nil
+}
+
+func parseRlimit(spec string) (int, syscall.Rlimit, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	resource, ok := rlimitNames[strings.ToLower(parts[0])]
+	if len(parts) != 2 || !ok {
+		return 0, syscall.Rlimit{}, fmt.Errorf("Invalid rlimit %q, expected NAME=SOFT[:HARD]", spec)
+	}
+
+	values := strings.SplitN(parts[1], ":", 2)
+	limits := []uint64{}
+	for _, value := range values {
+		if value == "unlimited" || value == "-1" {
+			limits = append(limits, rlimitUnset)
+			continue
+		}
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, syscall.Rlimit{}, fmt.Errorf("Invalid rlimit %q: %v", spec, err)
+		}
+		limits = append(limits, limit)
+	}
+	if len(limits) == 1 {
+		limits = append(limits, limits[0])
+	}
+
+	return resource, syscall.Rlimit{Cur: limits[0], Max: limits[1]}, nil
+}
+
+func parseUmask(umask string) (int, error) {
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid umask %q", umask)
+	}
+	return int(mask), nil
+}
+
+func (p ProcessConfig) check() error {
+	if p.User == "" && (p.Group != "" || len(p.Chown) > 0) {
+		return fmt.Errorf("--group and --chown require --user")
+	}
+	return nil
+}
+
+func chownRecursive(root string, uid, gid int) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+// apply changes the current process: rlimits and umask first, then volume
+// ownership and the working directory while still privileged. The switch to
+// the target user and group is returned rather than made, because it has to
+// happen for the command only, see execAs. Everything is parsed and looked
+// up before anything is changed, so invalid options leave the process as it
+// was.
+func (p ProcessConfig) apply() (*syscall.Credential, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+
+	resources := []int{}
+	limits := []syscall.Rlimit{}
+	for _, spec := range p.Rlimits {
+		resource, limit, err := parseRlimit(spec)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, resource)
+		limits = append(limits, limit)
+	}
+
+	mask := -1
+	if p.Umask != "" {
+		var err error
+		if mask, err = parseUmask(p.Umask); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		user   passwdEntry
+		groups []int
+	)
+	if p.User != "" {
+		var err error
+		if user, groups, err = p.credentials(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Workdir != "" {
+		if info, err := os.Stat(p.Workdir); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("Workdir %s is not a directory", p.Workdir)
+		}
+	}
+
+	for i, resource := range resources {
+		if err := syscall.Setrlimit(resource, &limits[i]); err != nil {
+			return nil, fmt.Errorf("Failed to set rlimit %s: %v", p.Rlimits[i], err)
+		}
+	}
+
+	if mask != -1 {
+		syscall.Umask(mask)
+	}
+
+	for _, path := range p.Chown {
+		logrus.Infof("Changing ownership of %s to %d:%d", path, user.uid, user.gid)
+		if err := chownRecursive(path, user.uid, user.gid); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Workdir != "" {
+		if err := os.Chdir(p.Workdir); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.User == "" {
+		return nil, nil
+	}
+
+	credential := &syscall.Credential{
+		Uid: uint32(user.uid),
+		Gid: uint32(user.gid),
+	}
+	for _, gid := range groups {
+		credential.Groups = append(credential.Groups, uint32(gid))
+	}
+	return credential, os.Setenv("HOME", user.home)
+}
+
+// execAs executes the command, as the user of credential if not nil.
+// syscall.Setuid and Setgid do not work on Linux before Go 1.16, and the
+// system calls only change the calling thread, so they are made on a locked
+// thread right before that thread executes the command.
+func execAs(name string, argv, env []string, credential *syscall.Credential) error {
+	if credential == nil {
+		return syscall.Exec(name, argv, env)
+	}
+
+	// The thread is never unlocked: if the exec fails it is left with the
+	// credentials of the user, and must not run other goroutines.
+	runtime.LockOSThread()
+
+	var groups unsafe.Pointer
+	if len(credential.Groups) > 0 {
+		groups = unsafe.Pointer(&credential.Groups[0])
+	}
+	if _, _, errno := syscall.RawSyscall(sysSetgroups, uintptr(len(credential.Groups)), uintptr(groups), 0); errno != 0 {
+		return fmt.Errorf("Failed to set groups: %v", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(sysSetgid, uintptr(credential.Gid), 0, 0); errno != 0 {
+		return fmt.Errorf("Failed to set gid %d: %v", credential.Gid, errno)
+	}
+	if _, _, errno := syscall.RawSyscall(sysSetuid, uintptr(credential.Uid), 0, 0); errno != 0 {
+		return fmt.Errorf("Failed to set uid %d: %v", credential.Uid, errno)
+	}
+
+	return syscall.Exec(name, argv, env)
+}
@@ -0,0 +1,218 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const testPasswd = `# comment
+root:x:0:0:root:/root:/bin/sh
+app:x:1000:1000::/home/app:/bin/sh
+broken:x:nope:1:::
+short:x:1002
+worker:x:1001:100:Worker:/srv/worker:/bin/false
+`
+
+const testGroup = `root:x:0:
+users:x:100:
+app:x:1000:
+staff:x:50:app, worker
+docker:x:999:worker
+broken:x:nope:app
+`
+
+// usePasswdFiles points the lookups to test copies of /etc/passwd and
+// /etc/group until the returned function is called.
+func usePasswdFiles(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, dir, map[string]string{"passwd": testPasswd, "group": testGroup}, nil)
+
+	savedPasswd, savedGroup := passwdFile, groupFile
+	passwdFile, groupFile = filepath.Join(dir, "passwd"), filepath.Join(dir, "group")
+	return func() {
+		passwdFile, groupFile = savedPasswd, savedGroup
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	defer usePasswdFiles(t)()
+
+	tests := []struct {
+		name    string
+		want    passwdEntry
+		wantErr string
+	}{
+		{"app", passwdEntry{name: "app", uid: 1000, gid: 1000, home: "/home/app"}, ""},
+		{"1001", passwdEntry{name: "worker", uid: 1001, gid: 100, home: "/srv/worker"}, ""},
+		{"0", passwdEntry{name: "root", uid: 0, gid: 0, home: "/root"}, ""},
+		{"4242", passwdEntry{name: "4242", uid: 4242, gid: 4242, home: "/"}, ""},
+		{"nobody", passwdEntry{}, "Unknown user: nobody"},
+		{"broken", passwdEntry{}, "Unknown user: broken"},
+		{"short", passwdEntry{}, "Unknown user: short"},
+	}
+	for _, test := range tests {
+		got, err := lookupUser(test.name)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%s: got %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %+v, %v, want %+v", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestLookupGroup(t *testing.T) {
+	defer usePasswdFiles(t)()
+
+	tests := []struct {
+		name    string
+		want    groupEntry
+		wantErr string
+	}{
+		{"staff", groupEntry{name: "staff", gid: 50, members: []string{"app", "worker"}}, ""},
+		{"999", groupEntry{name: "docker", gid: 999, members: []string{"worker"}}, ""},
+		{"4242", groupEntry{name: "4242", gid: 4242}, ""},
+		{"nogroup", groupEntry{}, "Unknown group: nogroup"},
+		{"broken", groupEntry{}, "Unknown group: broken"},
+	}
+	for _, test := range tests {
+		got, err := lookupGroup(test.name)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%s: got %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, %v, want %+v", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	defer usePasswdFiles(t)()
+
+	tests := []struct {
+		user, group string
+		gid         int
+		groups      []int
+	}{
+		{"app", "", 1000, []int{1000, 50}},
+		{"worker", "", 100, []int{100, 50, 999}},
+		{"worker", "docker", 999, []int{999, 50}},
+		{"app", "4242", 4242, []int{4242, 50}},
+		{"4242", "", 4242, []int{4242}},
+	}
+	for _, test := range tests {
+		user, groups, err := ProcessConfig{User: test.user, Group: test.group}.credentials()
+		if err != nil {
+			t.Errorf("%s:%s: %v", test.user, test.group, err)
+			continue
+		}
+		if user.gid != test.gid || !reflect.DeepEqual(groups, test.groups) {
+			t.Errorf("%s:%s: got gid %d and groups %v, want %d and %v", test.user, test.group, user.gid, groups, test.gid, test.groups)
+		}
+	}
+
+	if _, _, err := (ProcessConfig{User: "app", Group: "nogroup"}).credentials(); err == nil {
+		t.Error("an unknown group should fail")
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	defer usePasswdFiles(t)()
+
+	tests := []struct {
+		owner    string
+		uid, gid int
+		wantErr  bool
+	}{
+		{"", -1, -1, false},
+		{"app", 1000, -1, false},
+		{"app:staff", 1000, 50, false},
+		{":docker", -1, 999, false},
+		{"1234:5678", 1234, 5678, false},
+		{"nobody", 0, 0, true},
+		{"app:nogroup", 0, 0, true},
+	}
+	for _, test := range tests {
+		uid, gid, err := parseOwner(test.owner)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q should fail", test.owner)
+			}
+			continue
+		}
+		if err != nil || uid != test.uid || gid != test.gid {
+			t.Errorf("%q: got %d:%d, %v, want %d:%d", test.owner, uid, gid, err, test.uid, test.gid)
+		}
+	}
+}
+
+func TestParseRlimit(t *testing.T) {
+	tests := []struct {
+		spec     string
+		resource int
+		limit    syscall.Rlimit
+		wantErr  bool
+	}{
+		{"nofile=1024", syscall.RLIMIT_NOFILE, syscall.Rlimit{Cur: 1024, Max: 1024}, false},
+		{"NOFILE=1024:4096", syscall.RLIMIT_NOFILE, syscall.Rlimit{Cur: 1024, Max: 4096}, false},
+		{"core=unlimited", syscall.RLIMIT_CORE, syscall.Rlimit{Cur: rlimitUnset, Max: rlimitUnset}, false},
+		{"nproc=-1:100", rlimitNproc, syscall.Rlimit{Cur: rlimitUnset, Max: 100}, false},
+		{"nofile", 0, syscall.Rlimit{}, true},
+		{"files=10", 0, syscall.Rlimit{}, true},
+		{"nofile=ten", 0, syscall.Rlimit{}, true},
+	}
+	for _, test := range tests {
+		resource, limit, err := parseRlimit(test.spec)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q should fail", test.spec)
+			}
+			continue
+		}
+		if err != nil || resource != test.resource || limit != test.limit {
+			t.Errorf("%q: got %d %+v, %v, want %d %+v", test.spec, resource, limit, err, test.resource, test.limit)
+		}
+	}
+}
+
+func TestApplyValidatesFirst(t *testing.T) {
+	defer usePasswdFiles(t)()
+
+	umask := syscall.Umask(022)
+	defer syscall.Umask(umask)
+
+	tests := []struct {
+		config  ProcessConfig
+		message string
+	}{
+		{ProcessConfig{Umask: "077", User: "nobody"}, "Unknown user: nobody"},
+		{ProcessConfig{Umask: "077", User: "app", Group: "nogroup"}, "Unknown group: nogroup"},
+		{ProcessConfig{Umask: "077", Group: "app"}, "require --user"},
+		{ProcessConfig{Umask: "077", Rlimits: []string{"nofile=ten"}}, "Invalid rlimit"},
+		{ProcessConfig{Umask: "778"}, "Invalid umask"},
+		{ProcessConfig{Umask: "077", Workdir: "/nonexistent"}, "no such file"},
+	}
+	for _, test := range tests {
+		if _, err := test.config.apply(); err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%+v: got %v, want %q", test.config, err, test.message)
+		}
+		if current := syscall.Umask(022); current != 022 {
+			t.Errorf("%+v: umask was changed to %#o before the error", test.config, current)
+		}
+	}
+}
@@ -2,12 +2,10 @@ package app
 
 import (
   "github.com/urfave/cli"
-  "net/http"
   "net/url"
   "errors"
   "time"
   "math"
-  "net"
   "fmt"
   "os"
 )
@@ -16,7 +14,7 @@ func ProbeCommand() cli.Command {
 
   return cli.Command{
     Name:  "probe",
-    Usage: "Probe a TCP/HTTP(S) endpoint to determine if it is healthy",
+    Usage: "Probe a TCP/TLS/HTTP(S)/UDP/unix/DNS/gRPC/database endpoint to determine if it is healthy",
     ArgsUsage: "<endpoint>",
     Action: probe,
     Flags: []cli.Flag{
@@ -49,6 +47,64 @@ func ProbeCommand() cli.Command {
         Usage: "(Loop) Maximum number of requests to perform before declaring unhealthy. 0 for infinite",
         Value: 0,
       },
+      cli.StringFlag{
+        Name:  "method, X",
+        Usage: "(HTTP) Request method, GET or POST with --data by default",
+      },
+      cli.StringSliceFlag{
+        Name:  "header, H",
+        Usage: "(HTTP) Request header as NAME: VALUE. Can use the flag multiple times",
+      },
+      cli.StringFlag{
+        Name:  "data, d",
+        Usage: "(HTTP) Request body",
+      },
+      cli.StringFlag{
+        Name:  "host",
+        Usage: "(HTTP) Override the Host header",
+      },
+      cli.IntFlag{
+        Name:  "max-redirects",
+        Usage: "(HTTP) Maximum number of redirects to follow, 0 to not follow any",
+        Value: defaultMaxRedirects,
+      },
+      cli.StringFlag{
+        Name:  "expect-status",
+        Usage: "(HTTP) Accepted status codes, such as 200,204, 200-399 or 2xx",
+        Value: "2xx",
+      },
+      cli.StringFlag{
+        Name:  "expect-body",
+        Usage: "(HTTP) Regular expression the response body must match",
+      },
+      cli.StringSliceFlag{
+        Name:  "expect-json",
+        Usage: "(HTTP) Value expected in a JSON response as PATH=VALUE, e.g. status=ok or checks.db.healthy=true. Can use the flag multiple times",
+      },
+      cli.StringFlag{
+        Name:  "cacert",
+        Usage: "(TLS) Verify the server certificate with this CA instead of the system ones",
+      },
+      cli.StringFlag{
+        Name:  "cert",
+        Usage: "(TLS) Client certificate to present",
+      },
+      cli.StringFlag{
+        Name:  "key",
+        Usage: "(TLS) Key of the client certificate",
+      },
+      cli.BoolFlag{
+        Name:  "insecure, k",
+        Usage: "(TLS) Do not verify the server certificate",
+      },
+      cli.StringFlag{
+        Name:  "servername",
+        Usage: "(TLS) Server name to send and verify, instead of the host of the endpoint",
+      },
+      cli.DurationFlag{
+        Name:  "cert-min-validity",
+        Usage: "(TLS) Fail if the server certificate expires within this time, e.g. 72h",
+      },
     },
   }
 }
@@ -59,6 +115,12 @@ func probe(c *cli.Context) error {
     os.Exit(1)
   }
 
+  endpoint := c.Args().First()
+  options, err := parseProbeOptions(c)
+  if err != nil {
+    return err
+  }
+
   if c.Bool("loop") {
     min := c.Duration("min")
     max := c.Duration("max")
@@ -67,7 +129,7 @@ func probe(c *cli.Context) error {
     loops := 0
     delay := min
 
-    for err := healthCheck(c); err != nil; err = healthCheck(c) {
+    for err := healthCheck(endpoint, options); err != nil; err = healthCheck(endpoint, options) {
       fmt.Println(err)
       loops += 1
       if num != 0 && loops == num {
@@ -85,7 +147,7 @@ func probe(c *cli.Context) error {
     fmt.Println("OK")
 
   } else {
-    if err := healthCheck(c); err != nil {
+    if err := healthCheck(endpoint, options); err != nil {
       fmt.Println(err)
       os.Exit(1)
     }
@@ -94,10 +156,7 @@ func probe(c *cli.Context) error {
   return nil
 }
 
-func healthCheck(c *cli.Context) error {
-  endpoint := c.Args().First()
-  timeout := c.Duration("timeout")
-
+func healthCheck(endpoint string, options probeOptions) error {
   url, err := url.Parse(endpoint)
   if err != nil {
     return err
@@ -105,28 +164,29 @@ func healthCheck(c *cli.Context) error {
 
   switch url.Scheme {
   case "tcp":
-    var conn net.Conn
-    if conn, err = net.DialTimeout(url.Scheme, url.Host, timeout); err != nil {
-      return err
-    }
-    conn.Close()
+    _, err = tcpCheck(url, options)
+  case "tls":
+    _, err = tlsCheck(url.Host, options)
   case "http", "https":
-    client := &http.Client{
-      Timeout: timeout,
-    }
-    var resp *http.Response
-    resp, err = client.Get(endpoint)
-
-    switch {
-    case err != nil:
-      return err
-    case resp.StatusCode >= 200 && resp.StatusCode <= 299:
-      return nil
-    default:
-      return errors.New(fmt.Sprintf("HTTP %d\n", resp.StatusCode))
-    }
+    _, err = httpCheck(endpoint, options)
+  case "unix":
+    _, err = unixCheck(url, options)
+  case "udp":
+    _, err = udpCheck(url, options)
+  case "dns":
+    _, err = dnsCheck(url, options)
+  case "grpc":
+    _, err = grpcCheck(url, options)
+  case "redis":
+    _, err = redisCheck(url, options)
+  case "mysql":
+    _, err = mysqlCheck(url, options)
+  case "postgres", "postgresql":
+    _, err = postgresCheck(url, options)
+  case "memcached":
+    _, err = memcachedCheck(url, options)
   default:
     return errors.New(fmt.Sprintf("Unsupported URL scheme: %s\n", url.Scheme))
   }
-  return nil
+  return err
 }
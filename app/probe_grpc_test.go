@@ -0,0 +1,120 @@
+package app
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+type grpcTestServer struct {
+	net.Listener
+	// open is the number of connections not closed yet.
+	open int32
+}
+
+// grpcHealthServer answers health checks over h2c with the serving status
+// of the requested service, and with NOT_FOUND for unknown services.
+func grpcHealthServer(t *testing.T, statuses map[string]byte) *grpcTestServer {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != grpcHealthPath || r.Header.Get("Content-Type") != "application/grpc" || len(body) < 5 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		// The request is the message prefix, then service = 1 with a
+		// single byte length.
+		service := ""
+		if message := body[5:]; len(message) > 2 && message[0] == 0x0a {
+			service = string(message[2 : 2+int(message[1])])
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		status, ok := statuses[service]
+		if !ok {
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "unknown%20service")
+			return
+		}
+
+		reply := []byte{0, 0, 0, 0, 0}
+		if status != 0 {
+			reply = append(reply, 0x08, status)
+		}
+		binary.BigEndian.PutUint32(reply[1:], uint32(len(reply)-5))
+		w.Write(reply)
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &grpcTestServer{Listener: listener}
+	go func() {
+		server := &http2.Server{}
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.open, 1)
+			go func() {
+				server.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+				atomic.AddInt32(&s.open, -1)
+			}()
+		}
+	}()
+	return s
+}
+
+func TestGRPCCheck(t *testing.T) {
+	listener := grpcHealthServer(t, map[string]byte{
+		"":         1,
+		"api":      1,
+		"worker":   2,
+		"starting": 0,
+	})
+	defer listener.Close()
+	address := listener.Addr().String()
+
+	tests := []struct {
+		service string
+		wantErr string
+	}{
+		{"", ""},
+		{"api", ""},
+		{"worker", "gRPC health status is NOT_SERVING"},
+		{"starting", "gRPC health status is UNKNOWN"},
+		{"missing", "gRPC status 5: unknown service"},
+	}
+	for _, test := range tests {
+		checkURL(t, grpcCheck, "grpc://"+address+"/"+test.service, test.wantErr)
+	}
+
+	listener.Close()
+	checkURL(t, grpcCheck, "grpc://"+address, "connection refused")
+}
+
+func TestGRPCCheckClosesConnections(t *testing.T) {
+	server := grpcHealthServer(t, map[string]byte{"": 1})
+	defer server.Close()
+
+	for i := 0; i < 5; i++ {
+		checkURL(t, grpcCheck, "grpc://"+server.Addr().String(), "")
+	}
+
+	for i := 0; i < 100 && atomic.LoadInt32(&server.open) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if open := atomic.LoadInt32(&server.open); open > 0 {
+		t.Fatalf("%d connections were left open", open)
+	}
+}
@@ -0,0 +1,244 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxProbeBody is how much of a response body is read to match against.
+const maxProbeBody = 1 << 20
+
+type statusRange struct {
+	min, max int
+}
+
+func (r statusRange) String() string {
+	if r.min == r.max {
+		return strconv.Itoa(r.min)
+	}
+	if r.min%100 == 0 && r.max == r.min+99 {
+		return fmt.Sprintf("%dxx", r.min/100)
+	}
+	return fmt.Sprintf("%d-%d", r.min, r.max)
+}
+
+// httpRequest is the request an HTTP check sends.
+type httpRequest struct {
+	method string
+	header http.Header
+	body   string
+	// host overrides the Host header, e.g. to reach a virtual host by IP.
+	host         string
+	maxRedirects int
+}
+
+// jsonExpectation is a value expected at a dotted path of a JSON response,
+// such as status or checks.db.0.state.
+type jsonExpectation struct {
+	path  string
+	value string
+}
+
+// httpExpectation is what a response must look like for an HTTP check to
+// pass.
+type httpExpectation struct {
+	status []statusRange
+	body   *regexp.Regexp
+	json   []jsonExpectation
+}
+
+var defaultHTTPExpectation = httpExpectation{
+	status: []statusRange{{200, 299}},
+}
+
+// parseStatusRanges reads a comma separated list of codes such as 200,
+// 200-399 or 2xx. Codes must be between 100 and 599.
+func parseStatusRanges(spec string) ([]statusRange, error) {
+	ranges := []statusRange{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+
+		if len(part) == 3 && strings.HasSuffix(strings.ToLower(part), "xx") {
+			class, err := strconv.Atoi(part[:1])
+			if err != nil || class < 1 || class > 5 {
+				return nil, fmt.Errorf("Invalid status %q", part)
+			}
+			ranges = append(ranges, statusRange{class * 100, class*100 + 99})
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		min, err := strconv.Atoi(bounds[0])
+		if err != nil || min < 100 || min > 599 {
+			return nil, fmt.Errorf("Invalid status %q", part)
+		}
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.Atoi(bounds[1]); err != nil || max < min || max > 599 {
+				return nil, fmt.Errorf("Invalid status %q", part)
+			}
+		}
+		ranges = append(ranges, statusRange{min, max})
+	}
+	return ranges, nil
+}
+
+func (e httpExpectation) statusOK(code int) bool {
+	for _, r := range e.status {
+		if code >= r.min && code <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+func (e httpExpectation) statusString() string {
+	parts := []string{}
+	for _, r := range e.status {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// lookupJSON follows a dotted path through objects and arrays.
+func lookupJSON(doc interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			doc = value
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// checkJSON compares the values at each path. Strings are compared as they
+// are, anything else by its JSON encoding, so status=ok, ready=true and
+// count=3 all work.
+func (e httpExpectation) checkJSON(body []byte) error {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("body is not JSON: %v", err)
+	}
+
+	for _, expected := range e.json {
+		value, ok := lookupJSON(doc, expected.path)
+		if !ok {
+			return fmt.Errorf("JSON has no %s", expected.path)
+		}
+
+		actual, isString := value.(string)
+		if !isString {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			actual = string(encoded)
+		}
+		if actual != expected.value {
+			return fmt.Errorf("JSON %s is %s, expected %s", expected.path, actual, expected.value)
+		}
+	}
+	return nil
+}
+
+// httpCheck sends request to endpoint and checks the response against
+// expect. On success it returns a short description of the response, and
+// on failure the error names the assertion that failed.
+func httpCheck(endpoint string, options probeOptions) (string, error) {
+	request, expect := options.request, options.expect
+
+	client := &http.Client{
+		Timeout: options.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > request.maxRedirects {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	if options.tls != nil || options.socket != "" {
+		// The transport is built for this one request, so a connection
+		// kept alive could never be reused and would leak.
+		transport := &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   options.tls,
+			DisableKeepAlives: true,
+		}
+		if options.socket != "" {
+			transport.Proxy = nil
+			transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", options.socket)
+			}
+		}
+		client.Transport = transport
+	}
+
+	req, err := http.NewRequest(request.method, endpoint, strings.NewReader(request.body))
+	if err != nil {
+		return "", err
+	}
+	for name, values := range request.header {
+		req.Header[name] = values
+	}
+	if host := request.header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	if request.host != "" {
+		req.Host = request.host
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkCertValidity(resp.TLS, options.certMinValidity); err != nil {
+		return "", err
+	}
+
+	if !expect.statusOK(resp.StatusCode) {
+		return "", fmt.Errorf("HTTP %d, expected status %s", resp.StatusCode, expect.statusString())
+	}
+
+	if expect.body != nil || len(expect.json) > 0 {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+		if err != nil {
+			return "", err
+		}
+		if expect.body != nil && !expect.body.Match(body) {
+			return "", fmt.Errorf("HTTP %d, body does not match %q", resp.StatusCode, expect.body)
+		}
+		if len(expect.json) > 0 {
+			if err := expect.checkJSON(body); err != nil {
+				return "", fmt.Errorf("HTTP %d, %v", resp.StatusCode, err)
+			}
+		}
+	}
+
+	return fmt.Sprintf("HTTP %d", resp.StatusCode), nil
+}
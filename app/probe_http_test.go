@@ -0,0 +1,186 @@
+package app
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseStatusRanges(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []statusRange
+		display string
+	}{
+		{"200", []statusRange{{200, 200}}, "200"},
+		{"200,204", []statusRange{{200, 200}, {204, 204}}, "200,204"},
+		{"200-399", []statusRange{{200, 399}}, "200-399"},
+		{"2xx, 3XX", []statusRange{{200, 299}, {300, 399}}, "2xx,3xx"},
+		{"200-299", []statusRange{{200, 299}}, "2xx"},
+		{"404-404", []statusRange{{404, 404}}, "404"},
+	}
+	for _, test := range tests {
+		got, err := parseStatusRanges(test.spec)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, %v, want %v", test.spec, got, err, test.want)
+			continue
+		}
+		if display := (httpExpectation{status: got}).statusString(); display != test.display {
+			t.Errorf("%q: displayed as %q, want %q", test.spec, display, test.display)
+		}
+	}
+
+	for _, spec := range []string{
+		"", "ok", "200,", ",200", "20", "1000", "600", "099", "-200", "200-", "399-200", "200-600",
+		"200-300-400", "2xx-3xx", "0xx", "6xx", "axx", "x", "2x", "2xxx", "200 - 299",
+	} {
+		if got, err := parseStatusRanges(spec); err == nil {
+			t.Errorf("%q: got %v, want an error", spec, got)
+		} else if !strings.HasPrefix(err.Error(), "Invalid status") {
+			t.Errorf("%q: got error %q", spec, err)
+		}
+	}
+}
+
+func TestStatusOK(t *testing.T) {
+	expect := httpExpectation{status: []statusRange{{200, 204}, {301, 301}}}
+	for code, want := range map[int]bool{199: false, 200: true, 204: true, 205: false, 301: true, 302: false} {
+		if got := expect.statusOK(code); got != want {
+			t.Errorf("%d: got %v, want %v", code, got, want)
+		}
+	}
+}
+
+func TestCheckJSON(t *testing.T) {
+	body := []byte(`{
+		"status": "ok",
+		"ready": true,
+		"count": 3,
+		"ratio": 1.50,
+		"big": 12345678901234567890,
+		"none": null,
+		"quoted": "3",
+		"checks": [{"name": "db", "state": "up"}, {"name": "cache", "state": "down"}],
+		"meta": {"version": "1.2"},
+		"dotted.key": "x"
+	}`)
+
+	tests := []struct {
+		path, value string
+		wantErr     string
+	}{
+		{"status", "ok", ""},
+		{"ready", "true", ""},
+		{"count", "3", ""},
+		{"ratio", "1.50", ""},
+		{"big", "12345678901234567890", ""},
+		{"none", "null", ""},
+		{"quoted", "3", ""},
+		{"checks.0.state", "up", ""},
+		{"checks.1.name", "cache", ""},
+		{"meta", `{"version":"1.2"}`, ""},
+		{"meta.version", "1.2", ""},
+		{"status", "down", "JSON status is ok, expected down"},
+		{"ready", "false", "JSON ready is true, expected false"},
+		{"count", "3.0", "JSON count is 3, expected 3.0"},
+		{"ratio", "1.5", "JSON ratio is 1.50, expected 1.5"},
+		{"quoted", `"3"`, `JSON quoted is 3, expected "3"`},
+		{"checks.2.state", "up", "JSON has no checks.2.state"},
+		{"checks.-1.state", "up", "JSON has no checks.-1.state"},
+		{"checks.first.state", "up", "JSON has no checks.first.state"},
+		{"checks.0.state.more", "up", "JSON has no checks.0.state.more"},
+		{"count.0", "3", "JSON has no count.0"},
+		{"missing", "x", "JSON has no missing"},
+		{"dotted.key", "x", "JSON has no dotted.key"},
+		{"", "x", "JSON has no "},
+	}
+	for _, test := range tests {
+		expect := httpExpectation{json: []jsonExpectation{{test.path, test.value}}}
+		err := expect.checkJSON(body)
+		if test.wantErr == "" && err != nil || test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+			t.Errorf("%s=%s: got %v, want %q", test.path, test.value, err, test.wantErr)
+		}
+	}
+
+	// Every expectation must hold.
+	expect := httpExpectation{json: []jsonExpectation{{"status", "ok"}, {"ready", "false"}}}
+	if err := expect.checkJSON(body); err == nil {
+		t.Error("a failing second expectation passed")
+	}
+
+	for _, invalid := range []string{"", "ok", "{", `{"status": "ok"`} {
+		if err := expect.checkJSON([]byte(invalid)); err == nil || !strings.HasPrefix(err.Error(), "body is not JSON") {
+			t.Errorf("%q: got %v, want a JSON error", invalid, err)
+		}
+	}
+}
+
+func TestLookupJSONArrayRoot(t *testing.T) {
+	doc := []interface{}{"a", []interface{}{"b", "c"}}
+	tests := []struct {
+		path  string
+		want  interface{}
+		found bool
+	}{
+		{"0", "a", true},
+		{"1.1", "c", true},
+		{"2", nil, false},
+		{"1.2", nil, false},
+		{"1.-1", nil, false},
+		{"01", []interface{}{"b", "c"}, true},
+	}
+	for _, test := range tests {
+		got, found := lookupJSON(doc, test.path)
+		if found != test.found || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.path, got, found, test.want, test.found)
+		}
+	}
+}
+
+func TestHTTPCheckClosesConnections(t *testing.T) {
+	var (
+		lock sync.Mutex
+		open int
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch state {
+		case http.StateNew:
+			open++
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	options := newProbeOptions(time.Second)
+	options.tls = &tls.Config{InsecureSkipVerify: true}
+	for i := 0; i < 5; i++ {
+		if _, err := httpCheck(server.URL, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remaining := 0
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		remaining = open
+		lock.Unlock()
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d connections were left open", remaining)
+}
@@ -0,0 +1,267 @@
+package app
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// unixCheck connects to the unix socket of a unix:///path endpoint. With
+// ?http=/path it sends an HTTP request over the socket instead, checked
+// like any other HTTP endpoint.
+func unixCheck(u *url.URL, options probeOptions) (string, error) {
+	path := localPath(u)
+
+	if httpPath := queryParam(u, "http"); httpPath != "" {
+		options.socket = path
+		return httpCheck("http://localhost"+httpPath, options)
+	}
+
+	conn, err := net.DialTimeout("unix", path, options.timeout)
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+	return "connected to " + path, nil
+}
+
+// udpCheck sends the payload of ?send= to a udp://host:port endpoint and
+// waits for a reply, which must match the regular expression of ?expect=
+// if given. The payload may use URL escapes such as %0A.
+func udpCheck(u *url.URL, options probeOptions) (string, error) {
+	send := queryParam(u, "send")
+	if send == "" {
+		return "", fmt.Errorf("udp check %s needs send", u.Host)
+	}
+
+	var expect *regexp.Regexp
+	if value := queryParam(u, "expect"); value != "" {
+		var err error
+		if expect, err = regexp.Compile(value); err != nil {
+			return "", fmt.Errorf("Invalid expect %q: %v", value, err)
+		}
+	}
+
+	conn, err := net.DialTimeout("udp", u.Host, options.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(options.timeout))
+
+	if _, err := conn.Write([]byte(send)); err != nil {
+		return "", err
+	}
+
+	reply := make([]byte, 64*1024)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return "", err
+	}
+	if expect != nil && !expect.Match(reply[:n]) {
+		return "", fmt.Errorf("reply %q does not match %q", reply[:n], expect)
+	}
+	return fmt.Sprintf("%d bytes from %s", n, u.Host), nil
+}
+
+// dnsRecordTypes are the query types of the record types dnsCheck
+// supports.
+var dnsRecordTypes = map[string]uint16{
+	"A":     1,
+	"NS":    2,
+	"CNAME": 5,
+	"MX":    15,
+	"TXT":   16,
+	"AAAA":  28,
+	"SRV":   33,
+}
+
+// dnsCheck resolves the name of a dns://server[:port]/name?type=A endpoint
+// and fails unless there is at least one record. Without a server the
+// system resolver is used.
+func dnsCheck(u *url.URL, options probeOptions) (string, error) {
+	name := strings.TrimPrefix(u.Path, "/")
+	if name == "" {
+		return "", fmt.Errorf("dns check needs a name, e.g. dns://10.43.0.10/example.com")
+	}
+	recordType := strings.ToUpper(queryParam(u, "type"))
+	if recordType == "" {
+		recordType = "A"
+	}
+	qtype, ok := dnsRecordTypes[recordType]
+	if !ok {
+		return "", fmt.Errorf("Unsupported DNS record type %q, expected A, AAAA, CNAME, MX, NS, SRV or TXT", recordType)
+	}
+
+	var (
+		records int
+		err     error
+	)
+	if server := u.Host; server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		records, err = dnsQuery(server, name, qtype, options.timeout)
+	} else {
+		records, err = dnsLookup(name, recordType, options.timeout)
+	}
+	if err != nil {
+		return "", err
+	}
+	if records == 0 {
+		return "", fmt.Errorf("no %s records for %s", recordType, name)
+	}
+	return fmt.Sprintf("%d %s records for %s", records, recordType, name), nil
+}
+
+// dnsLookup counts the records of name with the system resolver.
+func dnsLookup(name, recordType string, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resolver := net.DefaultResolver
+
+	switch recordType {
+	case "A", "AAAA":
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		records := 0
+		for _, addr := range addrs {
+			if (addr.IP.To4() != nil) == (recordType == "A") {
+				records++
+			}
+		}
+		return records, err
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if cname == "" {
+			return 0, err
+		}
+		return 1, err
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, name)
+		return len(mxs), err
+	case "NS":
+		nss, err := resolver.LookupNS(ctx, name)
+		return len(nss), err
+	case "SRV":
+		_, srvs, err := resolver.LookupSRV(ctx, "", "", name)
+		return len(srvs), err
+	case "TXT":
+		txts, err := resolver.LookupTXT(ctx, name)
+		return len(txts), err
+	}
+	return 0, fmt.Errorf("Unsupported DNS record type %q", recordType)
+}
+
+// dnsQuery asks server over UDP for the records of type qtype of name, and
+// returns how many of the answers have that type. net.Resolver can not be
+// pointed at a given server before Go 1.9, so the messages are encoded by
+// hand.
+func dnsQuery(server, name string, qtype uint16, timeout time.Duration) (int, error) {
+	dnsErr := &net.DNSError{Name: name, Server: server}
+
+	query := make([]byte, 12, 512)
+	id := uint16(rand.Intn(1 << 16))
+	binary.BigEndian.PutUint16(query[0:], id)
+	// Recursion desired, and a single question.
+	query[2] = 0x01
+	binary.BigEndian.PutUint16(query[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			dnsErr.Err = "invalid name"
+			return 0, dnsErr
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	// End of the name, the type and class IN.
+	query = append(query, 0, byte(qtype>>8), byte(qtype), 0, 1)
+
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 64*1024)
+	var reply []byte
+	for reply == nil {
+		n, err := conn.Read(buf)
+		if err != nil {
+			dnsErr.Err = err.Error()
+			if netErr, ok := err.(net.Error); ok {
+				dnsErr.IsTimeout = netErr.Timeout()
+			}
+			return 0, dnsErr
+		}
+		// Skip anything that is not the answer to this query, until the
+		// deadline.
+		if n >= 12 && binary.BigEndian.Uint16(buf) == id && buf[2]&0x80 != 0 {
+			reply = buf[:n]
+		}
+	}
+
+	switch rcode := reply[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		dnsErr.Err = "no such host"
+		return 0, dnsErr
+	default:
+		dnsErr.Err = fmt.Sprintf("server answered with rcode %d", rcode)
+		return 0, dnsErr
+	}
+
+	dnsErr.Err = "invalid DNS message"
+	questions := int(binary.BigEndian.Uint16(reply[4:]))
+	answers := int(binary.BigEndian.Uint16(reply[6:]))
+	offset := 12
+	for i := 0; i < questions; i++ {
+		if offset = skipDNSName(reply, offset); offset < 0 {
+			return 0, dnsErr
+		}
+		// Type and class.
+		offset += 4
+	}
+
+	records := 0
+	for i := 0; i < answers; i++ {
+		if offset = skipDNSName(reply, offset); offset < 0 || offset+10 > len(reply) {
+			return 0, dnsErr
+		}
+		// Type, class, TTL and the length of the data.
+		if binary.BigEndian.Uint16(reply[offset:]) == qtype {
+			records++
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(reply[offset+8:]))
+	}
+	if offset > len(reply) {
+		return 0, dnsErr
+	}
+	return records, nil
+}
+
+// skipDNSName returns the offset after the name at offset of msg, or -1 if
+// the name runs past the end. A compression pointer ends a name.
+func skipDNSName(msg []byte, offset int) int {
+	for offset >= 0 && offset < len(msg) {
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1
+		case length&0xc0 == 0xc0:
+			return offset + 2
+		}
+		offset += 1 + length
+	}
+	return -1
+}
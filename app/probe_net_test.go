@@ -0,0 +1,155 @@
+package app
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkURL runs check against endpoint and compares the error with
+// wantErr, which is empty when the check should pass.
+func checkURL(t *testing.T, check func(*url.URL, probeOptions) (string, error), endpoint, wantErr string) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := check(u, newProbeOptions(2*time.Second))
+	switch {
+	case wantErr == "" && err != nil:
+		t.Fatalf("%s: unexpected error: %v", endpoint, err)
+	case wantErr != "" && err == nil:
+		t.Fatalf("%s: got %q, want an error containing %q", endpoint, result, wantErr)
+	case wantErr != "" && !strings.Contains(err.Error(), wantErr):
+		t.Fatalf("%s: got error %q, want %q", endpoint, err, wantErr)
+	}
+}
+
+func TestUDPCheck(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	address := conn.LocalAddr().String()
+
+	tests := []struct {
+		query   string
+		wantErr string
+	}{
+		{"send=ping", ""},
+		{"send=ping%0A&expect=^ping%0A$", ""},
+		{"send=ping&expect=pong", `does not match "pong"`},
+		{"expect=ping", "needs send"},
+		{"send=ping&expect=(", "Invalid expect"},
+	}
+	for _, test := range tests {
+		checkURL(t, udpCheck, "udp://"+address+"?"+test.query, test.wantErr)
+	}
+}
+
+func TestUnixCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "app.sock")
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+		}
+	}))
+
+	checkURL(t, unixCheck, "unix://"+socket, "")
+	checkURL(t, unixCheck, "unix://"+socket+"?http=/health", "")
+	checkURL(t, unixCheck, "unix://"+socket+"?http=/missing", "HTTP 404")
+	checkURL(t, unixCheck, "unix://"+filepath.Join(dir, "missing.sock"), "no such file")
+}
+
+// serveDNS answers queries for the names in records, and with NXDOMAIN
+// for any other name.
+func serveDNS(conn net.PacketConn, records map[string][][]byte) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := buf[:n]
+
+		labels := []string{}
+		offset := 12
+		for query[offset] != 0 {
+			labels = append(labels, string(query[offset+1:offset+1+int(query[offset])]))
+			offset += 1 + int(query[offset])
+		}
+		qtype := binary.BigEndian.Uint16(query[offset+1:])
+		question := query[12 : offset+5]
+
+		rdatas, ok := records[strings.Join(labels, ".")]
+		reply := []byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, byte(len(rdatas)), 0, 0, 0, 0}
+		if !ok {
+			reply[3] = 0x83
+		}
+		reply = append(reply, question...)
+		for _, rdata := range rdatas {
+			// A pointer to the name in the question, the type, class IN,
+			// a TTL of 60 and the data.
+			reply = append(reply, 0xc0, 12, byte(qtype>>8), byte(qtype), 0, 1, 0, 0, 0, 60, 0, byte(len(rdata)))
+			reply = append(reply, rdata...)
+		}
+		conn.WriteTo(reply, addr)
+	}
+}
+
+func TestDNSCheck(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveDNS(conn, map[string][][]byte{
+		"db.example.test": {{10, 0, 0, 1}, {10, 0, 0, 2}},
+		"empty.test":      {},
+	})
+	server := conn.LocalAddr().String()
+
+	tests := []struct {
+		endpoint string
+		wantErr  string
+	}{
+		{"dns://" + server + "/db.example.test", ""},
+		{"dns://" + server + "/db.example.test.?type=a", ""},
+		{"dns://" + server + "/empty.test", "no A records for empty.test"},
+		{"dns://" + server + "/missing.test", "lookup missing.test on " + server + ": no such host"},
+		{"dns://" + server + "/db..test", "invalid name"},
+		{"dns://" + server + "/db.example.test?type=PTR", "Unsupported DNS record type"},
+		{"dns://" + server, "needs a name"},
+	}
+	for _, test := range tests {
+		checkURL(t, dnsCheck, test.endpoint, test.wantErr)
+	}
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// defaultMaxRedirects is how many redirects Go's HTTP client follows.
+const defaultMaxRedirects = 10
+
+// probeOptions are how an endpoint is probed, beyond its URL.
+type probeOptions struct {
+	timeout time.Duration
+	request httpRequest
+	expect  httpExpectation
+
+	// tls is nil unless the probe command was given TLS options.
+	tls             *tls.Config
+	certMinValidity time.Duration
+
+	// socket is the unix socket HTTP requests are sent over, for
+	// unix:///path?http=/path endpoints.
+	socket string
+}
+
+// newProbeOptions returns the options of a plain probe: a connect, or a GET
+// that follows redirects and expects a 2xx.
+func newProbeOptions(timeout time.Duration) probeOptions {
+	return probeOptions{
+		timeout: timeout,
+		request: httpRequest{
+			method:       http.MethodGet,
+			header:       http.Header{},
+			maxRedirects: defaultMaxRedirects,
+		},
+		expect: defaultHTTPExpectation,
+	}
+}
+
+// parseProbeOptions reads the options of the probe command.
+func parseProbeOptions(c *cli.Context) (probeOptions, error) {
+	o := newProbeOptions(c.Duration("timeout"))
+
+	o.request.body = c.String("data")
+	o.request.host = c.String("host")
+	o.request.maxRedirects = c.Int("max-redirects")
+	if method := c.String("method"); method != "" {
+		o.request.method = strings.ToUpper(method)
+	} else if o.request.body != "" {
+		o.request.method = http.MethodPost
+	}
+
+	for _, header := range c.StringSlice("header") {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return o, fmt.Errorf("Invalid header %q, expected NAME: VALUE", header)
+		}
+		o.request.header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	var err error
+	if o.tls, err = newProbeTLSConfig(c); err != nil {
+		return o, err
+	}
+	o.certMinValidity = c.Duration("cert-min-validity")
+
+	if o.expect.status, err = parseStatusRanges(c.String("expect-status")); err != nil {
+		return o, err
+	}
+	if body := c.String("expect-body"); body != "" {
+		if o.expect.body, err = regexp.Compile(body); err != nil {
+			return o, fmt.Errorf("Invalid --expect-body %q: %v", body, err)
+		}
+	}
+	for _, spec := range c.StringSlice("expect-json") {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return o, fmt.Errorf("Invalid --expect-json %q, expected PATH=VALUE", spec)
+		}
+		o.expect.json = append(o.expect.json, jsonExpectation{path: parts[0], value: parts[1]})
+	}
+
+	return o, nil
+}
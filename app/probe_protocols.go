@@ -0,0 +1,298 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxBanner is how much of a reply is read to match against.
+const maxBanner = 64 * 1024
+
+// dialProbe connects to the host of u, on defaultPort if it has none, and
+// sets a deadline on the whole exchange.
+func dialProbe(u *url.URL, defaultPort string, options probeOptions) (net.Conn, error) {
+	address := u.Host
+	if u.Port() == "" && defaultPort != "" {
+		address = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", address, options.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(options.timeout))
+	return conn, nil
+}
+
+// tcpCheck connects to a tcp://host:port endpoint. With ?send= it sends a
+// payload, and with ?expect= it reads until the reply matches the regular
+// expression, e.g. tcp://smtp:25?expect=^220.
+func tcpCheck(u *url.URL, options probeOptions) (string, error) {
+	var expect *regexp.Regexp
+	if value := queryParam(u, "expect"); value != "" {
+		var err error
+		if expect, err = regexp.Compile(value); err != nil {
+			return "", fmt.Errorf("Invalid expect %q: %v", value, err)
+		}
+	}
+
+	conn, err := dialProbe(u, "", options)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if send := queryParam(u, "send"); send != "" {
+		if _, err := conn.Write([]byte(send)); err != nil {
+			return "", err
+		}
+	}
+
+	if expect == nil {
+		return "connected to " + u.Host, nil
+	}
+
+	reply := []byte{}
+	buf := make([]byte, 4096)
+	for len(reply) < maxBanner {
+		n, err := conn.Read(buf)
+		reply = append(reply, buf[:n]...)
+		if expect.Match(reply) {
+			return fmt.Sprintf("reply from %s matches %q", u.Host, expect), nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	return "", fmt.Errorf("reply %q does not match %q", reply, expect)
+}
+
+// readRedisReply reads a simple string or error reply.
+func readRedisReply(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return "", fmt.Errorf("redis: %s", line[1:])
+	}
+	return line, nil
+}
+
+// redisCommand encodes a command as an array of bulk strings.
+func redisCommand(args ...string) []byte {
+	var command bytes.Buffer
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return command.Bytes()
+}
+
+// redisCheck sends PING to a redis://[[user]:password@]host[:port]
+// endpoint, after AUTH if a password is given, and expects PONG. A server
+// still loading its data set answers with an error.
+func redisCheck(u *url.URL, options probeOptions) (string, error) {
+	conn, err := dialProbe(u, "6379", options)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	if password, ok := u.User.Password(); ok {
+		auth := redisCommand("AUTH", password)
+		if user := u.User.Username(); user != "" {
+			auth = redisCommand("AUTH", user, password)
+		}
+		if _, err := conn.Write(auth); err != nil {
+			return "", err
+		}
+		if _, err := readRedisReply(reader); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := conn.Write(redisCommand("PING")); err != nil {
+		return "", err
+	}
+	reply, err := readRedisReply(reader)
+	if err != nil {
+		return "", err
+	}
+	if reply != "+PONG" {
+		return "", fmt.Errorf("redis answered %q to PING", reply)
+	}
+	return "redis answered PONG", nil
+}
+
+// mysqlCheck reads the greeting a mysql://host[:port] server sends to every
+// new connection. A server that refuses connections, e.g. because there
+// are too many, sends an error packet instead.
+func mysqlCheck(u *url.URL, options probeOptions) (string, error) {
+	conn, err := dialProbe(u, "3306", options)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// Packets start with a 3 byte little endian length and a sequence id.
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length == 0 || length > maxBanner {
+		return "", fmt.Errorf("invalid mysql packet of %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return "", err
+	}
+
+	switch payload[0] {
+	case 0x0a:
+		version := payload[1:]
+		if end := bytes.IndexByte(version, 0); end >= 0 {
+			version = version[:end]
+		}
+		return fmt.Sprintf("MySQL %s", version), nil
+	case 0xff:
+		if len(payload) < 3 {
+			return "", fmt.Errorf("mysql: invalid error packet")
+		}
+		code := binary.LittleEndian.Uint16(payload[1:3])
+		return "", fmt.Errorf("mysql: error %d: %s", code, payload[3:])
+	}
+	return "", fmt.Errorf("mysql: unsupported protocol version %d", payload[0])
+}
+
+// postgresMessage writes a message without a type byte, as the first
+// messages of a connection are.
+func postgresMessage(conn net.Conn, body []byte) error {
+	message := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(message, uint32(4+len(body)))
+	_, err := conn.Write(append(message, body...))
+	return err
+}
+
+// postgresCheck starts a session with a postgres://[user@]host[:port][/db]
+// server, like pg_isready. It sends an SSLRequest, switches to TLS if the
+// server supports it, and sends a startup message. The server is ready if
+// it asks to authenticate, or rejects the session for any reason but still
+// starting up or shutting down.
+func postgresCheck(u *url.URL, options probeOptions) (string, error) {
+	conn, err := dialProbe(u, "5432", options)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	sslRequest := make([]byte, 4)
+	binary.BigEndian.PutUint32(sslRequest, 80877103)
+	if err := postgresMessage(conn, sslRequest); err != nil {
+		return "", err
+	}
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return "", err
+	}
+	switch answer[0] {
+	case 'S':
+		config := options.tls
+		if config == nil {
+			// Like libpq's default sslmode=prefer, which does not verify
+			// the certificate.
+			config = &tls.Config{InsecureSkipVerify: true}
+		}
+		conn = tls.Client(conn, config)
+	case 'N':
+	default:
+		return "", fmt.Errorf("postgres: unexpected answer %q to SSLRequest", answer)
+	}
+
+	user := u.User.Username()
+	if user == "" {
+		user = "postgres"
+	}
+	database := strings.TrimPrefix(u.Path, "/")
+	if database == "" {
+		database = user
+	}
+
+	// Protocol version 3.0 followed by name/value pairs.
+	startup := []byte{0, 3, 0, 0}
+	for _, param := range []string{"user", user, "database", database} {
+		startup = append(append(startup, param...), 0)
+	}
+	startup = append(startup, 0)
+	if err := postgresMessage(conn, startup); err != nil {
+		return "", err
+	}
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	length := int(binary.BigEndian.Uint32(header[1:]))
+	if length < 4 || length > maxBanner {
+		return "", fmt.Errorf("postgres: invalid message of %d bytes", length)
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return "", err
+	}
+
+	switch header[0] {
+	case 'R':
+		// Terminate the session instead of authenticating.
+		conn.Write([]byte{'X', 0, 0, 0, 4})
+		return "postgres is accepting connections", nil
+	case 'E':
+		fields := map[byte]string{}
+		for _, field := range bytes.Split(body, []byte{0}) {
+			if len(field) > 1 {
+				fields[field[0]] = string(field[1:])
+			}
+		}
+		// cannot_connect_now, sent while starting up, shutting down or
+		// in recovery without hot standby.
+		if fields['C'] == "57P03" {
+			return "", fmt.Errorf("postgres: %s", fields['M'])
+		}
+		return fmt.Sprintf("postgres is accepting connections (%s)", fields['M']), nil
+	}
+	return "", fmt.Errorf("postgres: unexpected message %q to startup", header[0])
+}
+
+// memcachedCheck sends version to a memcached://host[:port] server.
+func memcachedCheck(u *url.URL, options probeOptions) (string, error) {
+	conn, err := dialProbe(u, "11211", options)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("version\r\n")); err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "VERSION ") {
+		return "", fmt.Errorf("memcached answered %q to version", line)
+	}
+	return "memcached " + strings.TrimPrefix(line, "VERSION "), nil
+}
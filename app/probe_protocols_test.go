@@ -0,0 +1,213 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeServer accepts connections on a local port and hands each of them
+// to handle.
+func fakeServer(t *testing.T, handle func(conn net.Conn, reader *bufio.Reader)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn, bufio.NewReader(conn))
+			}()
+		}
+	}()
+	return listener
+}
+
+type protocolTest struct {
+	name string
+	// endpoint is formatted with the address of the fake server.
+	endpoint string
+	handle   func(conn net.Conn, reader *bufio.Reader)
+	wantErr  string
+}
+
+func runProtocolTests(t *testing.T, check func(*url.URL, probeOptions) (string, error), tests []protocolTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener := fakeServer(t, test.handle)
+			defer listener.Close()
+			checkURL(t, check, fmt.Sprintf(test.endpoint, listener.Addr()), test.wantErr)
+		})
+	}
+}
+
+func TestTCPCheck(t *testing.T) {
+	banner := func(conn net.Conn, reader *bufio.Reader) {
+		conn.Write([]byte("220 smtp ready\r\n"))
+	}
+	helo := func(conn net.Conn, reader *bufio.Reader) {
+		banner(conn, reader)
+		if line, err := reader.ReadString('\n'); err == nil && line == "HELO probe\r\n" {
+			conn.Write([]byte("250 hello\r\n"))
+		}
+	}
+	pong := func(conn net.Conn, reader *bufio.Reader) {
+		if line, err := reader.ReadString('\n'); err == nil && line == "PING #1\r\n" {
+			conn.Write([]byte("+PONG #1\r\n"))
+		}
+	}
+
+	runProtocolTests(t, tcpCheck, []protocolTest{
+		{"connect", "tcp://%s", banner, ""},
+		{"expect banner", "tcp://%s?expect=^220", banner, ""},
+		{"send and expect", "tcp://%s?send=HELO%%20probe%%0D%%0A&expect=250%%20hello", helo, ""},
+		{"banner mismatch", "tcp://%s?expect=^554", banner, `does not match "^554"`},
+		{"invalid expect", "tcp://%s?expect=(", banner, "Invalid expect"},
+		{"plus and hash", "tcp://%s?send=PING%%20%%231%%0D%%0A&expect=^\\+PONG%%20%%231", pong, ""},
+	})
+}
+
+// readRedisCommand reads an array of bulk strings.
+func readRedisCommand(reader *bufio.Reader) []string {
+	var count int
+	if _, err := fmt.Fscanf(reader, "*%d\r\n", &count); err != nil {
+		return nil
+	}
+	args := []string{}
+	for i := 0; i < count; i++ {
+		var length int
+		if _, err := fmt.Fscanf(reader, "$%d\r\n", &length); err != nil {
+			return nil
+		}
+		arg := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, arg); err != nil {
+			return nil
+		}
+		args = append(args, string(arg[:length]))
+	}
+	return args
+}
+
+// redisServer answers PING with reply, and requires AUTH if password is
+// set.
+func redisServer(password, reply string) func(net.Conn, *bufio.Reader) {
+	return func(conn net.Conn, reader *bufio.Reader) {
+		authenticated := password == ""
+		for {
+			args := readRedisCommand(reader)
+			switch {
+			case len(args) == 0:
+				return
+			case args[0] == "AUTH" && args[len(args)-1] == password:
+				authenticated = true
+				conn.Write([]byte("+OK\r\n"))
+			case args[0] == "AUTH":
+				conn.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+			case !authenticated:
+				conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			case args[0] == "PING":
+				conn.Write([]byte(reply))
+			}
+		}
+	}
+}
+
+func TestRedisCheck(t *testing.T) {
+	runProtocolTests(t, redisCheck, []protocolTest{
+		{"pong", "redis://%s", redisServer("", "+PONG\r\n"), ""},
+		{"loading", "redis://%s", redisServer("", "-LOADING Redis is loading the dataset in memory\r\n"), "redis: LOADING Redis is loading"},
+		{"unexpected reply", "redis://%s", redisServer("", "+OK\r\n"), `redis answered "+OK" to PING`},
+		{"password", "redis://:s3cret@%s", redisServer("s3cret", "+PONG\r\n"), ""},
+		{"user and password", "redis://app:s3cret@%s", redisServer("s3cret", "+PONG\r\n"), ""},
+		{"wrong password", "redis://:wrong@%s", redisServer("s3cret", "+PONG\r\n"), "redis: WRONGPASS"},
+		{"no password", "redis://%s", redisServer("s3cret", "+PONG\r\n"), "redis: NOAUTH"},
+	})
+}
+
+// mysqlServer sends payload as the first packet of every connection.
+func mysqlServer(payload string) func(net.Conn, *bufio.Reader) {
+	return func(conn net.Conn, reader *bufio.Reader) {
+		header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), 0}
+		conn.Write(append(header, payload...))
+	}
+}
+
+func TestMySQLCheck(t *testing.T) {
+	runProtocolTests(t, mysqlCheck, []protocolTest{
+		{"greeting", "mysql://%s", mysqlServer("\x0a8.0.33\x00\x08\x00\x00\x00salt"), ""},
+		{"too many connections", "mysql://%s", mysqlServer("\xff\x10\x04Too many connections"), "mysql: error 1040: Too many connections"},
+		{"short error packet", "mysql://%s", mysqlServer("\xff\x10"), "invalid error packet"},
+		{"old protocol", "mysql://%s", mysqlServer("\x09"), "unsupported protocol version 9"},
+		{"empty packet", "mysql://%s", mysqlServer(""), "invalid mysql packet of 0 bytes"},
+	})
+}
+
+// postgresServer refuses SSL with sslAnswer, and answers a startup message
+// for user app and database db with the message of type kind and body.
+func postgresServer(sslAnswer, kind byte, body string) func(net.Conn, *bufio.Reader) {
+	return func(conn net.Conn, reader *bufio.Reader) {
+		request := make([]byte, 8)
+		if _, err := io.ReadFull(reader, request); err != nil || binary.BigEndian.Uint32(request[4:]) != 80877103 {
+			return
+		}
+		conn.Write([]byte{sslAnswer})
+
+		length := make([]byte, 4)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return
+		}
+		startup := make([]byte, binary.BigEndian.Uint32(length)-4)
+		if _, err := io.ReadFull(reader, startup); err != nil {
+			return
+		}
+		if !bytes.Contains(startup, []byte("user\x00app\x00database\x00db\x00")) {
+			kind = 'Z'
+		}
+
+		message := []byte{kind, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(message[1:], uint32(4+len(body)))
+		conn.Write(append(message, body...))
+	}
+}
+
+func TestPostgresCheck(t *testing.T) {
+	md5Password := "\x00\x00\x00\x05salt"
+	startingUp := "SFATAL\x00C57P03\x00Mthe database system is starting up\x00\x00"
+	noRole := "SFATAL\x00C28000\x00Mrole \"app\" does not exist\x00\x00"
+
+	runProtocolTests(t, postgresCheck, []protocolTest{
+		{"authentication", "postgres://app@%s/db", postgresServer('N', 'R', md5Password), ""},
+		{"starting up", "postgres://app@%s/db", postgresServer('N', 'E', startingUp), "postgres: the database system is starting up"},
+		{"rejected session", "postgresql://app@%s/db", postgresServer('N', 'E', noRole), ""},
+		{"wrong startup", "postgres://other@%s/db", postgresServer('N', 'R', md5Password), "unexpected message 'Z'"},
+		{"invalid ssl answer", "postgres://app@%s/db", postgresServer('X', 'R', md5Password), "unexpected answer \"X\" to SSLRequest"},
+	})
+}
+
+// memcachedServer answers version with reply.
+func memcachedServer(reply string) func(net.Conn, *bufio.Reader) {
+	return func(conn net.Conn, reader *bufio.Reader) {
+		if line, err := reader.ReadString('\n'); err == nil && strings.TrimSpace(line) == "version" {
+			conn.Write([]byte(reply))
+		}
+	}
+}
+
+func TestMemcachedCheck(t *testing.T) {
+	runProtocolTests(t, memcachedCheck, []protocolTest{
+		{"version", "memcached://%s", memcachedServer("VERSION 1.6.21\r\n"), ""},
+		{"error", "memcached://%s", memcachedServer("ERROR\r\n"), `memcached answered "ERROR" to version`},
+		{"closed", "memcached://%s", memcachedServer(""), "EOF"},
+	})
+}
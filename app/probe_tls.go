@@ -0,0 +1,91 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// newProbeTLSConfig reads the TLS options of the probe command. It returns
+// nil when none are set, so that Go's defaults apply.
+func newProbeTLSConfig(c *cli.Context) (*tls.Config, error) {
+	caFile, certFile, keyFile := c.String("cacert"), c.String("cert"), c.String("key")
+	serverName, insecure := c.String("servername"), c.Bool("insecure")
+
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" && !insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("--cert and --key must be used together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// checkCertValidity fails if the leaf certificate of the peer expires
+// within minValidity.
+func checkCertValidity(state *tls.ConnectionState, minValidity time.Duration) error {
+	if minValidity <= 0 || state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	leaf := state.PeerCertificates[0]
+	left := time.Until(leaf.NotAfter)
+	if left < minValidity {
+		left -= left % time.Minute
+		return fmt.Errorf("certificate %s expires in %v, less than %v", leaf.Subject.CommonName, left, minValidity)
+	}
+	return nil
+}
+
+// tlsCheck only performs a TLS handshake with address.
+func tlsCheck(address string, options probeOptions) (string, error) {
+	config := options.tls
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	dialer := &net.Dialer{Timeout: options.timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if err := checkCertValidity(&state, options.certMinValidity); err != nil {
+		return "", err
+	}
+
+	leaf := state.PeerCertificates[0]
+	return fmt.Sprintf("TLS handshake with %s, certificate valid until %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339)), nil
+}
@@ -0,0 +1,278 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func RunCommand() cli.Command {
+	return cli.Command{
+		Name:      "run",
+		Usage:     "Prepare the environment and exec a command as described by a config file",
+		ArgsUsage: "[command ...]",
+		Action:    runAction,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "config, c",
+				Usage: "YAML or JSON file using the keys described in the README",
+				Value: "giddyup.yml",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "print the plan, the final command and the environment changes without executing anything",
+			},
+			cli.BoolFlag{
+				Name:  "show-values",
+				Usage: "with --dry-run, print the values of changed variables other than secrets",
+			},
+		},
+	}
+}
+
+// loadExecConfig reads a run config file. JSON is read as YAML, of which it
+// is a subset. Arguments left unset get the defaults of the exec flags.
+func loadExecConfig(file, metadataURL string) (*ExecConfig, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &ExecConfig{
+		MetadataURL:  metadataURL,
+		Secrets:      SecretsConfig{Dir: "/run/secrets"},
+		SourceFormat: "auto",
+		TemplateMode: "0644",
+	}
+
+	if err := unmarshalYAML(content, cfg, dashesToUnderscores); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return cfg, nil
+}
+
+func runAction(c *cli.Context) error {
+	cfg, err := loadExecConfig(c.String("config"), c.GlobalString("metadata-url"))
+	if err != nil {
+		return err
+	}
+
+	if len(c.Args()) > 0 {
+		cfg.Command = c.Args()
+	}
+
+	if c.Bool("dry-run") {
+		return cfg.run(newExecPlan(os.Stdout, c.Bool("show-values")))
+	}
+	return cfg.run(nil)
+}
+
+// execPlan records what a dry run would have done. All methods are no-ops
+// on a nil plan, which is what a real run passes.
+type execPlan struct {
+	out        io.Writer
+	environ    map[string]string
+	redacted   map[string]bool
+	showValues bool
+}
+
+func environMap() map[string]string {
+	envs := map[string]string{}
+	for _, env := range os.Environ() {
+		pair := strings.SplitN(env, "=", 2)
+		if len(pair) == 2 {
+			envs[pair[0]] = pair[1]
+		}
+	}
+	return envs
+}
+
+func newExecPlan(out io.Writer, showValues bool) *execPlan {
+	fmt.Fprintln(out, "Plan:")
+	return &execPlan{
+		out:        out,
+		environ:    environMap(),
+		redacted:   map[string]bool{},
+		showValues: showValues,
+	}
+}
+
+func (p *execPlan) step(format string, args ...interface{}) {
+	if p == nil {
+		return
+	}
+	fmt.Fprintf(p.out, "  "+format+"\n", args...)
+}
+
+// secrets notes variables whose values must not be printed.
+func (p *execPlan) secrets(step, from string, envs map[string]string) {
+	if p == nil {
+		return
+	}
+	for key := range envs {
+		p.redacted[key] = true
+	}
+	p.step("%s: %d variables from %s", step, len(envs), from)
+}
+
+// existing drops the files that do not exist yet. They may well be created
+// by an earlier step, which a dry run does not execute.
+func (p *execPlan) existing(kind string, files []string) []string {
+	if p == nil {
+		return files
+	}
+
+	found := []string{}
+	for _, file := range files {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			p.step("%s: %s does not exist yet, skipped", kind, file)
+			continue
+		}
+		found = append(found, file)
+	}
+	return found
+}
+
+func (p *execPlan) cloudInit(cc *CloudInitConfig) error {
+	directives, errs := cc.Directives()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	for _, directive := range directives {
+		p.step("cloud-init %s", directive)
+	}
+	return nil
+}
+
+func (p *execPlan) wait(conds []waitCondition, endpoints *endpointWait, timeout time.Duration) {
+	for _, cond := range conds {
+		state := "waiting"
+		if cond.met() {
+			state = "met"
+		}
+		p.step("wait for %s (%s)", cond, state)
+	}
+	if endpoints != nil {
+		mode := "all"
+		if endpoints.any {
+			mode = "any"
+		}
+		state := "healthy"
+		if failures := endpoints.check(); failures != nil {
+			state = fmt.Sprintf("waiting, %d failing", len(failures))
+		}
+		p.step("wait for %s of %s (%s)", mode, strings.Join(endpoints.endpoints, ", "), state)
+	}
+	if timeout > 0 {
+		p.step("wait timeout: %v", timeout)
+	}
+}
+
+func (p *execPlan) templates(args []string, mode, owner string) error {
+	if _, err := newTemplateWriter(mode, owner); err != nil {
+		return err
+	}
+	for _, spec := range parseTemplateSpecs(args) {
+		dst := spec.dst
+		if dst == "" {
+			dst = "stdout"
+		}
+		p.step("template: render %s to %s", spec.src, dst)
+	}
+	return nil
+}
+
+func (p *execPlan) process(pc ProcessConfig) error {
+	for _, spec := range pc.Rlimits {
+		if _, _, err := parseRlimit(spec); err != nil {
+			return err
+		}
+		p.step("rlimit: %s", spec)
+	}
+
+	if pc.Umask != "" {
+		if _, err := parseUmask(pc.Umask); err != nil {
+			return err
+		}
+		p.step("umask: %s", pc.Umask)
+	}
+
+	if err := pc.check(); err != nil {
+		return err
+	}
+
+	if pc.User != "" {
+		user, groups, err := pc.credentials()
+		if err != nil {
+			return err
+		}
+		p.step("user: %s (uid %d, gid %d, groups %v)", pc.User, user.uid, user.gid, groups)
+		for _, path := range pc.Chown {
+			p.step("chown: %s to %d:%d", path, user.uid, user.gid)
+		}
+		os.Setenv("HOME", user.home)
+	}
+
+	if pc.Workdir != "" {
+		p.step("workdir: %s", pc.Workdir)
+	}
+	return nil
+}
+
+// command prints the command that would be executed and how the
+// environment differs from the one giddyup was started with. Source files
+// and .env hooks hold credentials as often as secrets do, so values are
+// only printed with showValues, and never those read from secrets.
+func (p *execPlan) command(name string, argv []string, supervise bool, hooks SupervisorHooks) error {
+	mode := "exec"
+	if supervise {
+		mode = "supervise"
+	}
+	if hooks.PreStop != "" {
+		p.step("pre-stop: %s", hooks.PreStop)
+	}
+	if hooks.GracePeriod > 0 {
+		p.step("grace period: %v", hooks.GracePeriod)
+	}
+	if hooks.OnExit != "" {
+		p.step("on-exit: %s", hooks.OnExit)
+	}
+	fmt.Fprintf(p.out, "Command (%s): %s %q\n", mode, name, argv)
+
+	fmt.Fprintln(p.out, "Environment:")
+	after := environMap()
+	keys := []string{}
+	for key := range after {
+		keys = append(keys, key)
+	}
+	for key := range p.environ {
+		if _, ok := after[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		before, existed := p.environ[key]
+		value, exists := after[key]
+		if p.redacted[key] || !p.showValues {
+			value = "<redacted>"
+		}
+
+		switch {
+		case !exists:
+			fmt.Fprintf(p.out, "  - %s\n", key)
+		case !existed:
+			fmt.Fprintf(p.out, "  + %s=%s\n", key, value)
+		case before != after[key]:
+			fmt.Fprintf(p.out, "  ~ %s=%s\n", key, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExecPlanRedactsValues(t *testing.T) {
+	defer os.Unsetenv("GIDDYUP_TEST_CHANGED")
+	defer os.Unsetenv("GIDDYUP_TEST_REMOVED")
+	defer os.Unsetenv("GIDDYUP_TEST_ADDED")
+	defer os.Unsetenv("GIDDYUP_TEST_SECRET")
+
+	tests := []struct {
+		showValues bool
+		want       string
+	}{
+		{false, "  + GIDDYUP_TEST_ADDED=<redacted>\n  ~ GIDDYUP_TEST_CHANGED=<redacted>\n  - GIDDYUP_TEST_REMOVED\n  + GIDDYUP_TEST_SECRET=<redacted>\n"},
+		{true, "  + GIDDYUP_TEST_ADDED=from-env-file\n  ~ GIDDYUP_TEST_CHANGED=new\n  - GIDDYUP_TEST_REMOVED\n  + GIDDYUP_TEST_SECRET=<redacted>\n"},
+	}
+	for _, test := range tests {
+		os.Setenv("GIDDYUP_TEST_CHANGED", "old")
+		os.Setenv("GIDDYUP_TEST_REMOVED", "old")
+		os.Unsetenv("GIDDYUP_TEST_ADDED")
+		os.Unsetenv("GIDDYUP_TEST_SECRET")
+
+		var out bytes.Buffer
+		plan := newExecPlan(&out, test.showValues)
+		plan.secrets("secrets", "/run/secrets", map[string]string{"GIDDYUP_TEST_SECRET": "s3cret"})
+		os.Setenv("GIDDYUP_TEST_SECRET", "s3cret")
+		os.Setenv("GIDDYUP_TEST_ADDED", "from-env-file")
+		os.Setenv("GIDDYUP_TEST_CHANGED", "new")
+		os.Unsetenv("GIDDYUP_TEST_REMOVED")
+
+		if err := plan.command("/bin/true", []string{"true"}, false, SupervisorHooks{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Keep only the test's own variables.
+		got := ""
+		for _, line := range strings.SplitAfter(out.String(), "\n") {
+			if strings.Contains(line, "GIDDYUP_TEST_") {
+				got += line
+			}
+		}
+		if got != test.want {
+			t.Errorf("show values %v: got\n%s\nwant\n%s", test.showValues, got, test.want)
+		}
+		if strings.Contains(out.String(), "s3cret") {
+			t.Errorf("show values %v: the secret was printed", test.showValues)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// SecretsConfig controls how secret files are turned into variables, both
+// for the secrets directory and for FOO_FILE variables.
+type SecretsConfig struct {
+	Enabled    bool     `yaml:"enabled"`
+	Dir        string   `yaml:"dir"`
+	Prefix     string   `yaml:"prefix"`
+	Normalize  bool     `yaml:"normalize"`
+	Trim       bool     `yaml:"trim"`
+	Recursive  bool     `yaml:"recursive"`
+	Include    []string `yaml:"include"`
+	Exclude    []string `yaml:"exclude"`
+	NoOverride bool     `yaml:"no_override"`
+}
+
+func newSecretsConfig(c *cli.Context) SecretsConfig {
+	return SecretsConfig{
+		Enabled:    c.Bool("secret-envs"),
+		Dir:        c.String("secrets-dir"),
+		Prefix:     c.String("secrets-prefix"),
+		Normalize:  c.Bool("secrets-normalize"),
+		Trim:       c.Bool("secrets-trim"),
+		Recursive:  c.Bool("secrets-recursive"),
+		Include:    c.StringSlice("secrets-include"),
+		Exclude:    c.StringSlice("secrets-exclude"),
+		NoOverride: c.Bool("secrets-no-override"),
+	}
+}
+
+// matchesAny reports whether the relative path, or its base name, matches
+// one of the globs.
+func matchesAny(globs []string, rel string) bool {
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, filepath.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (o SecretsConfig) envName(rel string) string {
+	name := strings.ToUpper(strings.Replace(rel, string(filepath.Separator), "_", -1))
+	if o.Normalize {
+		name = strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	}
+	return o.Prefix + name
+}
+
+func (o SecretsConfig) value(content []byte) string {
+	if o.Trim {
+		return strings.TrimRight(string(content), " \t\r\n")
+	}
+	return string(content)
+}
+
+// readSecrets maps the files in the secrets directory to environment
+// variables named after the (upper cased) file names.
+func readSecrets(o SecretsConfig) (map[string]string, error) {
+	envs := map[string]string{}
+
+	err := filepath.Walk(o.Dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(o.Dir, file)
+		if err != nil {
+			return err
+		}
+
+		// Kubernetes updates secret and configmap volumes atomically through
+		// ..data and timestamped ..directories, which are not secrets.
+		if file != o.Dir && strings.HasPrefix(info.Name(), "..") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			// Walk does not follow links, so a link to a directory would
+			// otherwise be read as a file.
+			if info, err = os.Stat(file); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				logrus.Debugf("Skipping link to directory %s", file)
+				return nil
+			}
+		}
+
+		if info.IsDir() {
+			if file != o.Dir && !o.Recursive {
+				logrus.Debugf("Skipping secrets subdirectory %s", file)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if len(o.Include) > 0 && !matchesAny(o.Include, rel) {
+			return nil
+		}
+		if matchesAny(o.Exclude, rel) {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		envs[o.envName(rel)] = o.value(content)
+		return nil
+	})
+
+	return envs, err
+}
+
+// readFileEnvs implements the FOO_FILE=/path convention for the variables
+// matching names: the content of the file becomes the value of FOO and the
+// returned FOO_FILE variables are to be removed. Only listed variables are
+// converted since many tools use *_FILE variables of their own.
+func readFileEnvs(names []string, o SecretsConfig) (map[string]string, []string, error) {
+	envs := map[string]string{}
+	fileVars := []string{}
+
+	for _, env := range os.Environ() {
+		pair := strings.SplitN(env, "=", 2)
+		if len(pair) != 2 || !strings.HasSuffix(pair[0], "_FILE") {
+			continue
+		}
+
+		name := strings.TrimSuffix(pair[0], "_FILE")
+		if name == "" || !matchesAny(names, name) {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(pair[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		envs[name] = o.value(content)
+		fileVars = append(fileVars, pair[0])
+	}
+
+	return envs, fileVars, nil
+}
+
+func setEnvs(envs map[string]string, noOverride bool) {
+	for key, val := range envs {
+		if _, exists := os.LookupEnv(key); exists && noOverride {
+			logrus.Debugf("Not overriding existing variable %s", key)
+			continue
+		}
+		os.Setenv(key, val)
+	}
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTree creates files, by path relative to dir, and links, from path to
+// target.
+func writeTree(t *testing.T, dir string, files, links map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{
+		"db-password":  "s3cret\n",
+		"api.key":      "key ",
+		"notes.txt":    "x",
+		"nested/token": "t",
+	}, map[string]string{
+		"linked":     "nested",
+		"linked-key": "api.key",
+	})
+
+	tests := []struct {
+		name   string
+		config SecretsConfig
+		want   map[string]string
+	}{
+		{"plain", SecretsConfig{}, map[string]string{
+			"DB-PASSWORD": "s3cret\n", "API.KEY": "key ", "NOTES.TXT": "x", "LINKED-KEY": "key ",
+		}},
+		{"prefix, normalize and trim", SecretsConfig{Prefix: "APP_", Normalize: true, Trim: true}, map[string]string{
+			"APP_DB_PASSWORD": "s3cret", "APP_API_KEY": "key", "APP_NOTES_TXT": "x", "APP_LINKED_KEY": "key",
+		}},
+		{"recursive", SecretsConfig{Recursive: true}, map[string]string{
+			"DB-PASSWORD": "s3cret\n", "API.KEY": "key ", "NOTES.TXT": "x", "LINKED-KEY": "key ", "NESTED_TOKEN": "t",
+		}},
+		{"include", SecretsConfig{Include: []string{"db-*", "*.key"}}, map[string]string{
+			"DB-PASSWORD": "s3cret\n", "API.KEY": "key ",
+		}},
+		{"include by path", SecretsConfig{Recursive: true, Include: []string{"nested/*"}}, map[string]string{
+			"NESTED_TOKEN": "t",
+		}},
+		{"exclude", SecretsConfig{Exclude: []string{"*.txt", "linked-*"}}, map[string]string{
+			"DB-PASSWORD": "s3cret\n", "API.KEY": "key ",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Dir = dir
+			got, err := readSecrets(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadSecretsKubernetesVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The layout of a secret volume: the keys link through ..data to the
+	// directory of the current version.
+	writeTree(t, dir, map[string]string{
+		"..2024_01_01_00_00_00.000000001/username": "app",
+		"..2024_01_01_00_00_00.000000001/password": "s3cret",
+	}, map[string]string{
+		"..data":   "..2024_01_01_00_00_00.000000001",
+		"username": "..data/username",
+		"password": "..data/password",
+	})
+
+	want := map[string]string{"USERNAME": "app", "PASSWORD": "s3cret"}
+	for _, recursive := range []bool{false, true} {
+		got, err := readSecrets(SecretsConfig{Dir: dir, Recursive: recursive})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("recursive %v: got %q, want %q", recursive, got, want)
+		}
+	}
+}
+
+func TestReadFileEnvs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{"password": "s3cret\n"}, nil)
+
+	os.Setenv("GIDDYUP_TEST_PASSWORD_FILE", filepath.Join(dir, "password"))
+	os.Setenv("GIDDYUP_OTHER_FILE", filepath.Join(dir, "missing"))
+	defer os.Unsetenv("GIDDYUP_TEST_PASSWORD_FILE")
+	defer os.Unsetenv("GIDDYUP_OTHER_FILE")
+
+	envs, fileVars, err := readFileEnvs([]string{"GIDDYUP_TEST_*"}, SecretsConfig{Trim: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"GIDDYUP_TEST_PASSWORD": "s3cret"}; !reflect.DeepEqual(envs, want) {
+		t.Fatalf("got %q, want %q", envs, want)
+	}
+	if want := []string{"GIDDYUP_TEST_PASSWORD_FILE"}; !reflect.DeepEqual(fileVars, want) {
+		t.Fatalf("got %q, want %q", fileVars, want)
+	}
+
+	if _, _, err := readFileEnvs([]string{"GIDDYUP_OTHER"}, SecretsConfig{}); err == nil {
+		t.Fatal("a missing file should fail")
+	}
+}
+
+func TestSetEnvsNoOverride(t *testing.T) {
+	os.Setenv("GIDDYUP_TEST_SET", "old")
+	defer os.Unsetenv("GIDDYUP_TEST_SET")
+	defer os.Unsetenv("GIDDYUP_TEST_NEW")
+
+	setEnvs(map[string]string{"GIDDYUP_TEST_SET": "new", "GIDDYUP_TEST_NEW": "new"}, true)
+	if got := os.Getenv("GIDDYUP_TEST_SET"); got != "old" {
+		t.Fatalf("existing variable was overridden with %q", got)
+	}
+	if got := os.Getenv("GIDDYUP_TEST_NEW"); got != "new" {
+		t.Fatalf("new variable is %q, want new", got)
+	}
+
+	setEnvs(map[string]string{"GIDDYUP_TEST_SET": "new"}, false)
+	if got := os.Getenv("GIDDYUP_TEST_SET"); got != "new" {
+		t.Fatalf("variable was not overridden, got %q", got)
+	}
+}
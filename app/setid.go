@@ -0,0 +1,12 @@
+//go:build !386 && !arm
+// +build !386,!arm
+
+package app
+
+import "syscall"
+
+const (
+	sysSetgroups = syscall.SYS_SETGROUPS
+	sysSetgid    = syscall.SYS_SETGID
+	sysSetuid    = syscall.SYS_SETUID
+)
@@ -0,0 +1,13 @@
+//go:build 386 || arm
+// +build 386 arm
+
+package app
+
+import "syscall"
+
+// 32 bit x86 and ARM have 16 bit ids in the original system calls.
+const (
+	sysSetgroups = syscall.SYS_SETGROUPS32
+	sysSetgid    = syscall.SYS_SETGID32
+	sysSetuid    = syscall.SYS_SETUID32
+)
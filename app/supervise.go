@@ -0,0 +1,414 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	prSetChildSubreaper = 36
+
+	// pAll makes waitid wait for any child.
+	pAll = 0
+)
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"TTIN":  syscall.SIGTTIN,
+	"TTOU":  syscall.SIGTTOU,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// forwardedSignals are relayed to the child. SIGCHLD is handled by the
+// supervisor itself to reap processes.
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGQUIT,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+	syscall.SIGALRM,
+	syscall.SIGTERM,
+	syscall.SIGCONT,
+	syscall.SIGTSTP,
+	syscall.SIGTTIN,
+	syscall.SIGTTOU,
+	syscall.SIGWINCH,
+}
+
+// exitCodeEnv passes the exit code of the command to the on-exit hook.
+const exitCodeEnv = "GIDDYUP_EXIT_CODE"
+
+// SupervisorHooks are shell commands run around the life of the child.
+type SupervisorHooks struct {
+	// PreStop runs when SIGTERM arrives, before it is forwarded.
+	PreStop string
+	// GracePeriod is how long the child has to exit after SIGTERM was
+	// forwarded before it is killed. 0 waits forever.
+	GracePeriod time.Duration
+	// OnExit runs after the child exited, with its exit code in
+	// GIDDYUP_EXIT_CODE.
+	OnExit string
+
+	// drain runs when SIGTERM arrives, before PreStop.
+	drain func()
+}
+
+// Supervisor runs a command as a child process and stays in the foreground,
+// forwarding signals to the child and reaping any orphaned processes.
+type Supervisor struct {
+	command   []string
+	signalMap map[syscall.Signal]syscall.Signal
+	hooks     SupervisorHooks
+	pid       int
+
+	// credential is the user the command and hooks run as, if not nil.
+	credential *syscall.Credential
+
+	// reapOrphans makes the supervisor a subreaper that collects every
+	// exited process, not only the child. It must be off when other parts
+	// of giddyup wait for processes of their own.
+	reapOrphans bool
+	stopping    bool
+
+	// waiters receive the status of hook processes, which would otherwise
+	// be collected by reap like any orphan.
+	lock    sync.Mutex
+	waiters map[int]chan syscall.WaitStatus
+}
+
+func NewSupervisor(command []string, signalMap map[syscall.Signal]syscall.Signal, hooks SupervisorHooks) *Supervisor {
+	return &Supervisor{
+		command:   command,
+		signalMap: signalMap,
+		hooks:     hooks,
+		waiters:   map[int]chan syscall.WaitStatus{},
+
+		reapOrphans: true,
+	}
+}
+
+// Run starts the command and blocks until it exits. The returned code is the
+// child's exit status, or 128+signal if it was killed by a signal.
+func (s *Supervisor) Run() (int, error) {
+	if len(s.command) == 0 {
+		return 1, fmt.Errorf("No command to supervise")
+	}
+
+	name, err := exec.LookPath(s.command[0])
+	if err != nil {
+		return 1, err
+	}
+
+	if s.reapOrphans && os.Getpid() != 1 {
+		// Orphans are only reparented to us if we are init or a subreaper.
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+			logrus.Warnf("Failed to become a child subreaper: %v", errno)
+		}
+	}
+
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs, append(forwardedSignals, syscall.SIGCHLD)...)
+	defer signal.Stop(sigs)
+
+	cmd := exec.Command(name)
+	cmd.Args = s.command
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = s.sysProcAttr()
+	if err := cmd.Start(); err != nil {
+		return 1, err
+	}
+	s.pid = cmd.Process.Pid
+	logrus.Debugf("Started %s with pid %d", name, s.pid)
+
+	var (
+		preStopped chan struct{}
+		grace      <-chan time.Time
+	)
+
+	for {
+		select {
+		case sig := <-sigs:
+			switch {
+			case sig == syscall.SIGCHLD:
+				if status, exited := s.reap(); exited {
+					code := exitCode(status)
+					s.onExit(code)
+					return code, nil
+				}
+			case sig == syscall.SIGTERM && !s.stopping && (s.hooks.PreStop != "" || s.hooks.drain != nil):
+				s.stopping = true
+				preStopped = make(chan struct{})
+				go func(done chan struct{}) {
+					if s.hooks.drain != nil {
+						s.hooks.drain()
+					}
+					if s.hooks.PreStop != "" {
+						if err := s.runHook("pre-stop", s.hooks.PreStop); err != nil {
+							logrus.Error(err)
+						}
+					}
+					close(done)
+				}(preStopped)
+			case sig == syscall.SIGTERM && !s.stopping:
+				s.stopping = true
+				grace = s.stop()
+			default:
+				if sig == syscall.SIGINT || sig == syscall.SIGQUIT {
+					s.stopping = true
+				}
+				s.forward(sig.(syscall.Signal))
+			}
+		case <-preStopped:
+			preStopped = nil
+			grace = s.stop()
+		case <-grace:
+			grace = nil
+			logrus.Warnf("Pid %d did not exit within %v, killing it", s.pid, s.hooks.GracePeriod)
+			if err := syscall.Kill(s.pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				logrus.Errorf("Failed to kill pid %d: %v", s.pid, err)
+			}
+		}
+	}
+}
+
+// Stopping reports whether the child was asked to stop with SIGTERM, SIGINT
+// or SIGQUIT.
+func (s *Supervisor) Stopping() bool {
+	return s.stopping
+}
+
+// stop forwards SIGTERM and returns a channel that fires when the grace
+// period is over, or nil if there is none.
+func (s *Supervisor) stop() <-chan time.Time {
+	s.forward(syscall.SIGTERM)
+	if s.hooks.GracePeriod > 0 {
+		return time.After(s.hooks.GracePeriod)
+	}
+	return nil
+}
+
+// runHook runs a hook while the supervisor is reaping. Its status is handed
+// over by reap, so the usual cmd.Wait cannot be used.
+func (s *Supervisor) runHook(name, command string) error {
+	logrus.Infof("Running %s hook", name)
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = s.sysProcAttr()
+
+	done := make(chan syscall.WaitStatus, 1)
+	s.lock.Lock()
+	if err := cmd.Start(); err != nil {
+		s.lock.Unlock()
+		return fmt.Errorf("%s hook: %v", name, err)
+	}
+	s.waiters[cmd.Process.Pid] = done
+	s.lock.Unlock()
+
+	status := <-done
+	cmd.Process.Release()
+	if code := exitCode(status); code != 0 {
+		return fmt.Errorf("%s hook failed with exit code %d", name, code)
+	}
+	return nil
+}
+
+// onExit runs the on-exit hook. Nothing else is reaping any more, so it can
+// be waited for as usual.
+func (s *Supervisor) onExit(code int) {
+	if s.hooks.OnExit == "" {
+		return
+	}
+
+	logrus.Infof("Running on-exit hook")
+	cmd := exec.Command("/bin/sh", "-c", s.hooks.OnExit)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", exitCodeEnv, code))
+	cmd.SysProcAttr = s.sysProcAttr()
+	if err := cmd.Run(); err != nil {
+		logrus.Errorf("on-exit hook failed: %v", err)
+	}
+}
+
+func (s *Supervisor) sysProcAttr() *syscall.SysProcAttr {
+	if s.credential == nil {
+		return nil
+	}
+	return &syscall.SysProcAttr{Credential: s.credential}
+}
+
+func (s *Supervisor) forward(sig syscall.Signal) {
+	if mapped, ok := s.signalMap[sig]; ok {
+		logrus.Debugf("Rewriting signal %v to %v", sig, mapped)
+		sig = mapped
+	}
+	if err := syscall.Kill(s.pid, sig); err != nil && err != syscall.ESRCH {
+		logrus.Errorf("Failed to forward signal %v to pid %d: %v", sig, s.pid, err)
+	}
+}
+
+// ownProcesses are the processes that other parts of giddyup start and
+// wait for with cmd.Wait, such as health check commands. A supervisor that
+// reaps orphans next to them must leave them alone.
+var ownProcesses = struct {
+	sync.Mutex
+	pids map[int]bool
+}{pids: map[int]bool{}}
+
+// runOwnProcess is cmd.Run for a process that a reaping supervisor must not
+// collect.
+func runOwnProcess(cmd *exec.Cmd) error {
+	ownProcesses.Lock()
+	err := cmd.Start()
+	if err == nil {
+		ownProcesses.pids[cmd.Process.Pid] = true
+	}
+	ownProcesses.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Wait()
+
+	ownProcesses.Lock()
+	delete(ownProcesses.pids, cmd.Process.Pid)
+	ownProcesses.Unlock()
+	// A supervisor stops reaping at an exited process it must leave alone.
+	// Have it look again for the ones behind.
+	syscall.Kill(os.Getpid(), syscall.SIGCHLD)
+	return err
+}
+
+// exitedChild returns the pid of an exited child without collecting it, or
+// 0 if there is none.
+func exitedChild() (int, error) {
+	// si_pid follows si_signo, si_errno and si_code, aligned to a pointer.
+	var info [128]byte
+	offset := (12 + unsafe.Sizeof(uintptr(0)) - 1) / unsafe.Sizeof(uintptr(0)) * unsafe.Sizeof(uintptr(0))
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pAll, 0, uintptr(unsafe.Pointer(&info[0])),
+		syscall.WEXITED|syscall.WNOHANG|syscall.WNOWAIT, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(*(*int32)(unsafe.Pointer(&info[offset]))), nil
+}
+
+// reap collects every exited child without blocking and reports whether the
+// supervised command was among them.
+func (s *Supervisor) reap() (syscall.WaitStatus, bool) {
+	var childStatus syscall.WaitStatus
+	childExited := false
+
+	for {
+		wait := s.pid
+		if s.reapOrphans {
+			ownProcesses.Lock()
+			pid, err := exitedChild()
+			if err == syscall.EINTR {
+				ownProcesses.Unlock()
+				continue
+			}
+			if err != nil || pid <= 0 || ownProcesses.pids[pid] {
+				ownProcesses.Unlock()
+				break
+			}
+			wait = pid
+		}
+
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(wait, &status, syscall.WNOHANG, nil)
+		if s.reapOrphans {
+			ownProcesses.Unlock()
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			break
+		}
+		if pid == s.pid {
+			childStatus = status
+			childExited = true
+			continue
+		}
+
+		s.lock.Lock()
+		waiter, ok := s.waiters[pid]
+		delete(s.waiters, pid)
+		s.lock.Unlock()
+
+		if ok {
+			waiter <- status
+		} else {
+			logrus.Debugf("Reaped orphaned process %d", pid)
+		}
+	}
+
+	return childStatus, childExited
+}
+
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	if num, err := strconv.Atoi(name); err == nil {
+		return syscall.Signal(num), nil
+	}
+
+	name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("Unknown signal: %s", name)
+}
+
+// parseSignalMap reads FROM:TO pairs such as TERM:QUIT.
+func parseSignalMap(pairs []string) (map[syscall.Signal]syscall.Signal, error) {
+	signalMap := map[syscall.Signal]syscall.Signal{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid signal mapping %q, expected FROM:TO", pair)
+		}
+		from, err := parseSignal(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseSignal(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		signalMap[from] = to
+	}
+	return signalMap, nil
+}
@@ -0,0 +1,271 @@
+package app
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestSupervisorHelper is not a test by itself. The supervisor becomes a
+// subreaper and takes over signals for the whole process, so the tests
+// below run it in a copy of the test binary, with the command after --
+// and its options in GIDDYUP_TEST_* variables.
+func TestSupervisorHelper(t *testing.T) {
+	if os.Getenv("GIDDYUP_TEST_SUPERVISOR") == "" {
+		return
+	}
+
+	signalMap, err := parseSignalMap(strings.Fields(os.Getenv("GIDDYUP_TEST_SIGNAL_MAP")))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(100)
+	}
+	hooks := SupervisorHooks{
+		PreStop: os.Getenv("GIDDYUP_TEST_PRE_STOP"),
+		OnExit:  os.Getenv("GIDDYUP_TEST_ON_EXIT"),
+	}
+	if grace := os.Getenv("GIDDYUP_TEST_GRACE_PERIOD"); grace != "" {
+		hooks.GracePeriod, _ = time.ParseDuration(grace)
+	}
+
+	// Run check commands, as the health server does, while orphans are
+	// reaped, and write whether all of them got their own exit status.
+	if os.Getenv("GIDDYUP_TEST_OWN_PROCESSES") != "" {
+		go func() {
+			result := "ok"
+			for i := 0; i < 200; i++ {
+				if _, err := commandProbe([]string{"/bin/sh", "-c", "exit 3"})(context.Background()); err == nil || err.Error() != "exit status 3" {
+					result = fmt.Sprintf("probe %d: %v", i, err)
+					break
+				}
+			}
+			ioutil.WriteFile("probes", []byte(result), 0644)
+		}()
+	}
+
+	code, err := NewSupervisor(flag.Args(), signalMap, hooks).Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(100)
+	}
+	os.Exit(code)
+}
+
+// supervisorTest is a directory for the files a supervised script writes.
+type supervisorTest struct {
+	t   *testing.T
+	dir string
+}
+
+func newSupervisorTest(t *testing.T) *supervisorTest {
+	dir, err := ioutil.TempDir("", "supervise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &supervisorTest{t: t, dir: dir}
+}
+
+func (s *supervisorTest) Close() {
+	os.RemoveAll(s.dir)
+}
+
+// start supervises script, which runs in the test directory, with the
+// given GIDDYUP_TEST_* options.
+func (s *supervisorTest) start(script string, env ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSupervisorHelper$", "--", "/bin/sh", "-c", script)
+	cmd.Dir = s.dir
+	cmd.Env = append(os.Environ(), append(env, "GIDDYUP_TEST_SUPERVISOR=1")...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		s.t.Fatal(err)
+	}
+	return cmd
+}
+
+// wait returns the exit code of the supervisor.
+func (s *supervisorTest) wait(cmd *exec.Cmd) int {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		return 0
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		s.t.Fatal("supervisor did not exit")
+	}
+	return -1
+}
+
+// waitFile waits for the script to create name and returns its content.
+func (s *supervisorTest) waitFile(name string) string {
+	for i := 0; i < 100; i++ {
+		if content, err := ioutil.ReadFile(filepath.Join(s.dir, name)); err == nil {
+			return string(content)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	s.t.Fatalf("%s was not created", name)
+	return ""
+}
+
+func TestSupervisorExitCode(t *testing.T) {
+	s := newSupervisorTest(t)
+	defer s.Close()
+
+	if code := s.wait(s.start("exit 3")); code != 3 {
+		t.Fatalf("got exit code %d, want 3", code)
+	}
+	if code := s.wait(s.start("kill -USR1 $$")); code != 128+int(syscall.SIGUSR1) {
+		t.Fatalf("got exit code %d, want %d", code, 128+int(syscall.SIGUSR1))
+	}
+	if code := s.wait(s.start("exec /nonexistent")); code != 127 {
+		t.Fatalf("got exit code %d, want 127", code)
+	}
+}
+
+func TestSupervisorForwardsMappedSignal(t *testing.T) {
+	s := newSupervisorTest(t)
+	defer s.Close()
+
+	cmd := s.start(`trap 'echo USR1 > got; exit 0' USR1
+trap 'echo TERM > got; exit 1' TERM
+touch ready
+while :; do sleep 0.05; done`, "GIDDYUP_TEST_SIGNAL_MAP=TERM:USR1")
+
+	s.waitFile("ready")
+	cmd.Process.Signal(syscall.SIGTERM)
+	if code := s.wait(cmd); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	if got := s.waitFile("got"); got != "USR1\n" {
+		t.Fatalf("child got %q, want USR1", got)
+	}
+}
+
+func TestSupervisorReapsOrphans(t *testing.T) {
+	s := newSupervisorTest(t)
+	defer s.Close()
+
+	// The subshell exits right away, so the background process is
+	// reparented to the supervisor. A zombie still answers kill -0, so the
+	// process only disappears once the supervisor has reaped it.
+	cmd := s.start(`(sh -c 'echo $$ > orphan; sleep 0.2' &)
+while [ ! -s orphan ]; do sleep 0.05; done
+pid=$(cat orphan)
+i=0
+while kill -0 $pid 2>/dev/null; do
+	i=$((i+1))
+	[ $i -gt 100 ] && exit 1
+	sleep 0.05
+done
+exit 0`)
+
+	if code := s.wait(cmd); code != 0 {
+		t.Fatal("orphaned process was not reaped")
+	}
+}
+
+func TestSupervisorLeavesOwnProcesses(t *testing.T) {
+	s := newSupervisorTest(t)
+	defer s.Close()
+
+	cmd := s.start(`while [ ! -f probes ]; do (sleep 0.01 &); sleep 0.01; done`, "GIDDYUP_TEST_OWN_PROCESSES=1")
+	if code := s.wait(cmd); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	if result := s.waitFile("probes"); result != "ok" {
+		t.Fatalf("check commands lost their status: %s", result)
+	}
+}
+
+func TestParseSignalMap(t *testing.T) {
+	signalMap, err := parseSignalMap([]string{"TERM:QUIT", "sighup:usr1", "10:2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[syscall.Signal]syscall.Signal{
+		syscall.SIGTERM:    syscall.SIGQUIT,
+		syscall.SIGHUP:     syscall.SIGUSR1,
+		syscall.Signal(10): syscall.SIGINT,
+	}
+	for from, to := range want {
+		if signalMap[from] != to {
+			t.Errorf("%v maps to %v, want %v", from, signalMap[from], to)
+		}
+	}
+
+	for _, pair := range []string{"TERM", "TERM:NOPE", "NOPE:TERM"} {
+		if _, err := parseSignalMap([]string{pair}); err == nil {
+			t.Errorf("%q should not parse", pair)
+		}
+	}
+}
+
+func TestSupervisorPreStop(t *testing.T) {
+	s := newSupervisorTest(t)
+	defer s.Close()
+
+	// The slow hook must finish before the child sees SIGTERM.
+	cmd := s.start(`trap 'echo term >> log; exit 0' TERM
+touch ready
+while :; do sleep 0.05; done`, "GIDDYUP_TEST_PRE_STOP=sleep 0.3; echo pre-stop >> log")
+
+	s.waitFile("ready")
+	cmd.Process.Signal(syscall.SIGTERM)
+	if code := s.wait(cmd); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	if log := s.waitFile("log"); log != "pre-stop\nterm\n" {
+		t.Fatalf("got %q, want the pre-stop hook before the child's trap", log)
+	}
+}
+
+func TestSupervisorGracePeriod(t *testing.T) {
+	s := newSupervisorTest(t)
+	defer s.Close()
+
+	cmd := s.start(`trap '' TERM
+touch ready
+while :; do sleep 0.05; done`, "GIDDYUP_TEST_GRACE_PERIOD=300ms")
+
+	s.waitFile("ready")
+	start := time.Now()
+	cmd.Process.Signal(syscall.SIGTERM)
+	if code := s.wait(cmd); code != 128+int(syscall.SIGKILL) {
+		t.Fatalf("got exit code %d, want %d", code, 128+int(syscall.SIGKILL))
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("child was killed after %v, before the grace period", elapsed)
+	}
+}
+
+func TestSupervisorOnExit(t *testing.T) {
+	s := newSupervisorTest(t)
+	defer s.Close()
+
+	cmd := s.start("exit 3", "GIDDYUP_TEST_ON_EXIT=echo $"+exitCodeEnv+" > code")
+	if code := s.wait(cmd); code != 3 {
+		t.Fatalf("got exit code %d, want 3", code)
+	}
+	if code := s.waitFile("code"); code != "3\n" {
+		t.Fatalf("on-exit hook got %s=%q, want 3", exitCodeEnv, code)
+	}
+}
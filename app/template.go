@@ -0,0 +1,291 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/giddyup/election"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/urfave/cli"
+)
+
+func TemplateCommand() cli.Command {
+	return cli.Command{
+		Name:      "template",
+		Usage:     "Render Go templates against Rancher metadata",
+		ArgsUsage: "<src>[:<dst>] ...",
+		Action:    templateAction,
+		Flags:     templateFlags(),
+		Subcommands: []cli.Command{
+			templateWatchCommand(),
+		},
+	}
+}
+
+func templateFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "mode",
+			Usage: "file mode of rendered files",
+			Value: "0644",
+		},
+		cli.StringFlag{
+			Name:  "owner",
+			Usage: "owner of rendered files, as user, user:group or :group",
+		},
+	}
+}
+
+// templateSpec is a template source and the file it renders to. An empty
+// dst renders to stdout.
+type templateSpec struct {
+	src string
+	dst string
+}
+
+func parseTemplateSpecs(args []string) []templateSpec {
+	specs := []templateSpec{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, ":", 2)
+		spec := templateSpec{src: parts[0]}
+		if len(parts) == 2 {
+			spec.dst = parts[1]
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// TemplateContext is the data passed to templates.
+type TemplateContext struct {
+	client metadata.Client
+
+	Self struct {
+		Container metadata.Container
+		Service   metadata.Service
+		Stack     metadata.Stack
+		Host      metadata.Host
+	}
+	// Metadata is the user defined metadata of this container's service.
+	Metadata map[string]interface{}
+}
+
+func NewTemplateContext(client metadata.Client) (*TemplateContext, error) {
+	var err error
+	ctx := &TemplateContext{client: client}
+
+	if ctx.Self.Container, err = client.GetSelfContainer(); err != nil {
+		return nil, err
+	}
+	if ctx.Self.Service, err = client.GetSelfService(); err != nil {
+		return nil, err
+	}
+	if ctx.Self.Stack, err = client.GetSelfStack(); err != nil {
+		return nil, err
+	}
+	if ctx.Self.Host, err = client.GetSelfHost(); err != nil {
+		return nil, err
+	}
+	ctx.Metadata = ctx.Self.Service.Metadata
+
+	return ctx, nil
+}
+
+// ServiceContainers returns the containers of a service given as
+// "stack/service" or "service" (in this stack). Without an argument the
+// containers of this container's service are returned.
+func (t *TemplateContext) ServiceContainers(name ...string) ([]metadata.Container, error) {
+	stack, service := t.Self.Container.StackName, t.Self.Container.ServiceName
+	if len(name) > 0 {
+		parts := strings.SplitN(name[0], "/", 2)
+		if len(parts) == 2 {
+			stack, service = parts[0], parts[1]
+		} else {
+			service = parts[0]
+		}
+	}
+	return t.client.GetServiceContainers(service, stack)
+}
+
+// ServiceIPs returns the primary IPs of a service's containers, see
+// ServiceContainers.
+func (t *TemplateContext) ServiceIPs(name ...string) ([]string, error) {
+	containers, err := t.ServiceContainers(name...)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []string{}
+	for _, container := range containers {
+		ips = append(ips, container.PrimaryIp)
+	}
+	return ips, nil
+}
+
+// Leader returns the leader container of this container's service.
+func (t *TemplateContext) Leader() (metadata.Container, error) {
+	leader, _, err := election.New(t.client, 0, nil).GetSelfServiceLeader()
+	return leader, err
+}
+
+// IsLeader reports whether this container is the leader of its service.
+func (t *TemplateContext) IsLeader() (bool, error) {
+	_, isLeader, err := election.New(t.client, 0, nil).GetSelfServiceLeader()
+	return isLeader, err
+}
+
+var templateFuncs = template.FuncMap{
+	"join":    templateJoin,
+	"sort":    templateSort,
+	"default": templateDefault,
+}
+
+func templateStrings(list interface{}) ([]string, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("Expected a list, got %T", list)
+	}
+
+	strs := make([]string, v.Len())
+	for i := range strs {
+		strs[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strs, nil
+}
+
+func templateJoin(sep string, list interface{}) (string, error) {
+	strs, err := templateStrings(list)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(strs, sep), nil
+}
+
+func templateSort(list interface{}) ([]string, error) {
+	strs, err := templateStrings(list)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(strs)
+	return strs, nil
+}
+
+func templateDefault(def interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || value[0] == nil {
+		return def
+	}
+
+	v := reflect.ValueOf(value[0])
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if v.Len() == 0 {
+			return def
+		}
+	}
+	return value[0]
+}
+
+func renderTemplate(src string, ctx *TemplateContext) ([]byte, error) {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New(filepath.Base(src)).Funcs(templateFuncs).Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, ctx); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// templateWriter renders templates and writes them with a fixed mode and
+// owner.
+type templateWriter struct {
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+func newTemplateWriter(mode, owner string) (*templateWriter, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid file mode %q", mode)
+	}
+
+	uid, gid, err := parseOwner(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	return &templateWriter{
+		mode: os.FileMode(perm),
+		uid:  uid,
+		gid:  gid,
+	}, nil
+}
+
+func (w *templateWriter) render(specs []templateSpec, ctx *TemplateContext) error {
+	for _, spec := range specs {
+		content, err := renderTemplate(spec.src, ctx)
+		if err != nil {
+			return fmt.Errorf("Failed to render %s: %v", spec.src, err)
+		}
+
+		if spec.dst == "" {
+			os.Stdout.Write(content)
+			continue
+		}
+
+		if err := writeFileAtomic(spec.dst, content, w.mode, w.uid, w.gid); err != nil {
+			return fmt.Errorf("Failed to write %s: %v", spec.dst, err)
+		}
+		logrus.Infof("Rendered %s to %s", spec.src, spec.dst)
+	}
+	return nil
+}
+
+func renderTemplates(metadataURL string, args []string, mode, owner string) error {
+	w, err := newTemplateWriter(mode, owner)
+	if err != nil {
+		return err
+	}
+
+	mdClient, err := metadata.NewClientAndWait(metadataURL)
+	if err != nil {
+		return err
+	}
+
+	ctx, err := NewTemplateContext(mdClient)
+	if err != nil {
+		return err
+	}
+
+	return w.render(parseTemplateSpecs(args), ctx)
+}
+
+func templateAction(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		cli.ShowAppHelp(c)
+		os.Exit(1)
+	}
+
+	err := renderTemplates(c.GlobalString("metadata-url"), c.Args(), c.String("mode"), c.String("owner"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/urfave/cli"
+)
+
+func templateWatchCommand() cli.Command {
+	return cli.Command{
+		Name:      "watch",
+		Usage:     "Re-render templates whenever metadata changes and reload the application",
+		ArgsUsage: "<src>:<dst> ...",
+		Action:    templateWatchAction,
+		Flags: append(templateFlags(),
+			cli.DurationFlag{
+				Name:  "debounce",
+				Usage: "wait for metadata to settle this long before rendering",
+				Value: 2 * time.Second,
+			},
+			cli.DurationFlag{
+				Name:  "min-interval",
+				Usage: "minimum time between two reloads",
+				Value: 10 * time.Second,
+			},
+			cli.StringFlag{
+				Name:  "signal",
+				Usage: "signal to send on reload",
+				Value: "HUP",
+			},
+			cli.StringFlag{
+				Name:  "pidfile",
+				Usage: "send the reload signal to the process in this pid file",
+			},
+			cli.StringFlag{
+				Name:  "process-name",
+				Usage: "send the reload signal to all processes with this name (requires a shared PID namespace)",
+			},
+			cli.StringFlag{
+				Name:  "reload-command",
+				Usage: "run this shell command on reload instead of sending a signal",
+			},
+		),
+	}
+}
+
+// reloader notifies the application that its configuration changed, either
+// by signaling it or by running a command. With neither configured the
+// application is expected to pick up changes on its own.
+type reloader struct {
+	signal      syscall.Signal
+	pidfile     string
+	processName string
+	command     string
+}
+
+func (r *reloader) reload() error {
+	if r.command != "" {
+		cmd := exec.Command("/bin/sh", "-c", r.command)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+
+	if r.pidfile == "" && r.processName == "" {
+		return nil
+	}
+
+	pids, err := r.pids()
+	if err != nil {
+		return err
+	}
+	if len(pids) == 0 {
+		return fmt.Errorf("No process found to signal")
+	}
+
+	for _, pid := range pids {
+		logrus.Infof("Sending %v to pid %d", r.signal, pid)
+		if err := syscall.Kill(pid, r.signal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *reloader) pids() ([]int, error) {
+	if r.pidfile != "" {
+		content, err := ioutil.ReadFile(r.pidfile)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pid file %s: %v", r.pidfile, err)
+		}
+		return []int{pid}, nil
+	}
+
+	return findProcesses(r.processName)
+}
+
+// findProcesses returns the pids of all processes whose name or executable
+// base name equals name.
+func findProcesses(name string) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pids := []int{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+
+		comm, err := ioutil.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == name {
+			pids = append(pids, pid)
+			continue
+		}
+
+		// comm is truncated to 15 characters, so also compare argv[0].
+		cmdline, err := ioutil.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]
+		if argv0 != "" && filepath.Base(argv0) == name {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// upToDate reports whether dst already has content and the mode and owner
+// the writer would give it.
+func (w *templateWriter) upToDate(dst string, content []byte) bool {
+	info, err := os.Stat(dst)
+	if err != nil || info.Mode().Perm() != w.mode.Perm() {
+		return false
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if (w.uid != -1 && int(stat.Uid) != w.uid) || (w.gid != -1 && int(stat.Gid) != w.gid) {
+			return false
+		}
+	}
+
+	current, err := ioutil.ReadFile(dst)
+	return err == nil && bytes.Equal(current, content)
+}
+
+// renderChanged renders the templates and writes only those whose content,
+// mode or owner differs from what is on disk. It reports whether any file
+// was written.
+func (w *templateWriter) renderChanged(specs []templateSpec, ctx *TemplateContext) (bool, error) {
+	changed := false
+	for _, spec := range specs {
+		content, err := renderTemplate(spec.src, ctx)
+		if err != nil {
+			return changed, fmt.Errorf("Failed to render %s: %v", spec.src, err)
+		}
+
+		if w.upToDate(spec.dst, content) {
+			continue
+		}
+
+		if err := writeFileAtomic(spec.dst, content, w.mode, w.uid, w.gid); err != nil {
+			return changed, fmt.Errorf("Failed to write %s: %v", spec.dst, err)
+		}
+		logrus.Infof("Rendered %s to %s", spec.src, spec.dst)
+		changed = true
+	}
+	return changed, nil
+}
+
+func templateWatchAction(c *cli.Context) error {
+	specs := parseTemplateSpecs(c.Args())
+	if len(specs) == 0 {
+		cli.ShowCommandHelp(c, "watch")
+		os.Exit(1)
+	}
+	for _, spec := range specs {
+		if spec.dst == "" {
+			logrus.Fatalf("No destination for template %s, expected src:dst", spec.src)
+		}
+	}
+
+	w, err := newTemplateWriter(c.String("mode"), c.String("owner"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	sig, err := parseSignal(c.String("signal"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	r := &reloader{
+		signal:      sig,
+		pidfile:     c.String("pidfile"),
+		processName: c.String("process-name"),
+		command:     c.String("reload-command"),
+	}
+
+	mdClient, err := metadata.NewClientAndWait(c.GlobalString("metadata-url"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	debounce := c.Duration("debounce")
+	minInterval := c.Duration("min-interval")
+
+	changes := make(chan string, 1)
+	go mdClient.OnChange(5, func(version string) {
+		select {
+		case changes <- version:
+		default:
+		}
+	})
+
+	// The first change notification carries the current version, which
+	// doubles as the initial render.
+	var lastReload time.Time
+	pending := false
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case version := <-changes:
+			logrus.Debugf("Metadata changed to version %s", version)
+			pending = true
+			timer.Reset(debounce)
+		case <-timer.C:
+			if !pending {
+				continue
+			}
+			if wait := minInterval - time.Since(lastReload); !lastReload.IsZero() && wait > 0 {
+				timer.Reset(wait)
+				continue
+			}
+			pending = false
+
+			ctx, err := NewTemplateContext(mdClient)
+			if err != nil {
+				logrus.Errorf("Failed to read metadata: %v", err)
+				continue
+			}
+
+			changed, err := w.renderChanged(specs, ctx)
+			if err != nil {
+				logrus.Error(err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+
+			lastReload = time.Now()
+			if err := r.reload(); err != nil {
+				logrus.Errorf("Failed to reload: %v", err)
+			}
+		}
+	}
+}
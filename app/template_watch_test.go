@@ -0,0 +1,62 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestRenderChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "app.conf.tmpl"), filepath.Join(dir, "app.conf")
+	if err := ioutil.WriteFile(src, []byte(`port={{ "8080" }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	specs := []templateSpec{{src, dst}}
+	w := &templateWriter{mode: 0640, uid: -1, gid: -1}
+
+	render := func(want bool) {
+		changed, err := w.renderChanged(specs, &TemplateContext{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != want {
+			t.Fatalf("renderChanged reported %v, want %v", changed, want)
+		}
+	}
+
+	render(true)
+	render(false)
+
+	if err := ioutil.WriteFile(dst, []byte("port=80"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	render(true)
+
+	if err := os.Chmod(dst, 0600); err != nil {
+		t.Fatal(err)
+	}
+	render(true)
+	if info, err := os.Stat(dst); err != nil || info.Mode().Perm() != 0640 {
+		t.Fatalf("got %v, %v, want mode 0640", info.Mode(), err)
+	}
+	render(false)
+
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner needs root")
+	}
+	w.gid = 1
+	render(true)
+	info, err := os.Stat(dst)
+	if err != nil || info.Sys().(*syscall.Stat_t).Gid != 1 {
+		t.Fatalf("group of %s was not changed", dst)
+	}
+	render(false)
+}
@@ -0,0 +1,306 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	waitPollInterval = 1 * time.Second
+	// waitRecheckInterval re-evaluates conditions while inotify is in use,
+	// for changes in directories that could not be watched, such as those
+	// matched by a wildcard.
+	waitRecheckInterval = 5 * time.Second
+	// inotifyRetryInterval is how often the inotify descriptor is read
+	// again when it had no events.
+	inotifyRetryInterval = 100 * time.Millisecond
+
+	inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_TO |
+		syscall.IN_MOVED_FROM | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY |
+		syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+)
+
+type waitKind int
+
+const (
+	waitExists waitKind = iota
+	waitNonEmpty
+	waitMatch
+	waitGlob
+	waitAbsent
+)
+
+// waitCondition is a condition on the file system that --wait-for-* flags
+// block on.
+type waitCondition struct {
+	kind  waitKind
+	path  string
+	re    *regexp.Regexp
+	count int
+}
+
+// WaitConfig lists the conditions to block on before starting the command.
+type WaitConfig struct {
+	Files    []string `yaml:"files"`
+	NonEmpty []string `yaml:"nonempty"`
+	Match    []string `yaml:"match"`
+	Globs    []string `yaml:"globs"`
+	Absent   []string `yaml:"absent"`
+	Timeout  string   `yaml:"timeout"`
+
+	Endpoints       []string `yaml:"endpoints"`
+	EndpointMode    string   `yaml:"endpoint_mode"`
+	EndpointTimeout string   `yaml:"endpoint_timeout"`
+}
+
+func newWaitConfig(c *cli.Context) WaitConfig {
+	return WaitConfig{
+		Files:    c.StringSlice("wait-for-file"),
+		NonEmpty: c.StringSlice("wait-for-nonempty"),
+		Match:    c.StringSlice("wait-for-match"),
+		Globs:    c.StringSlice("wait-for-glob"),
+		Absent:   c.StringSlice("wait-for-absent"),
+		Timeout:  c.Duration("wait-timeout").String(),
+
+		Endpoints:       c.StringSlice("wait-for-endpoint"),
+		EndpointMode:    c.String("wait-endpoint-mode"),
+		EndpointTimeout: c.Duration("wait-endpoint-timeout").String(),
+	}
+}
+
+func newWaitConditions(w WaitConfig) ([]waitCondition, error) {
+	conds := []waitCondition{}
+
+	for _, path := range w.Files {
+		conds = append(conds, waitCondition{kind: waitExists, path: path})
+	}
+
+	for _, path := range w.NonEmpty {
+		conds = append(conds, waitCondition{kind: waitNonEmpty, path: path})
+	}
+
+	for _, spec := range w.Match {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid --wait-for-match %q, expected PATH=REGEX", spec)
+		}
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --wait-for-match %q: %v", spec, err)
+		}
+		conds = append(conds, waitCondition{kind: waitMatch, path: parts[0], re: re})
+	}
+
+	for _, spec := range w.Globs {
+		cond := waitCondition{kind: waitGlob, path: spec, count: 1}
+		if idx := strings.LastIndex(spec, "="); idx >= 0 {
+			count, err := strconv.Atoi(spec[idx+1:])
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("Invalid --wait-for-glob %q, expected PATTERN[=COUNT]", spec)
+			}
+			cond.path, cond.count = spec[:idx], count
+		}
+		if _, err := filepath.Match(cond.path, ""); err != nil {
+			return nil, fmt.Errorf("Invalid --wait-for-glob %q: %v", spec, err)
+		}
+		conds = append(conds, cond)
+	}
+
+	for _, path := range w.Absent {
+		conds = append(conds, waitCondition{kind: waitAbsent, path: path})
+	}
+
+	return conds, nil
+}
+
+func (w waitCondition) String() string {
+	switch w.kind {
+	case waitNonEmpty:
+		return w.path + " to be non-empty"
+	case waitMatch:
+		return fmt.Sprintf("%s to match %q", w.path, w.re)
+	case waitGlob:
+		return fmt.Sprintf("%d file(s) matching %s", w.count, w.path)
+	case waitAbsent:
+		return w.path + " to be removed"
+	}
+	return w.path + " to exist"
+}
+
+func (w waitCondition) met() bool {
+	switch w.kind {
+	case waitExists:
+		_, err := os.Stat(w.path)
+		return err == nil
+	case waitNonEmpty:
+		info, err := os.Stat(w.path)
+		return err == nil && info.Size() > 0
+	case waitMatch:
+		content, err := ioutil.ReadFile(w.path)
+		return err == nil && w.re.Match(content)
+	case waitGlob:
+		matches, err := filepath.Glob(w.path)
+		return err == nil && len(matches) >= w.count
+	case waitAbsent:
+		_, err := os.Stat(w.path)
+		return os.IsNotExist(err)
+	}
+	return false
+}
+
+// watchDir returns the closest existing directory in which a change can
+// affect the condition.
+func (w waitCondition) watchDir() string {
+	dir := filepath.Dir(w.path)
+	if w.kind == waitGlob {
+		// Only the static part of the pattern can be watched.
+		for strings.ContainsAny(dir, "*?[") {
+			dir = filepath.Dir(dir)
+		}
+	}
+
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// inotifyWatcher signals on events when anything changes in the watched
+// directories.
+type inotifyWatcher struct {
+	fd     int
+	file   *os.File
+	events chan struct{}
+}
+
+func newInotifyWatcher() (*inotifyWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &inotifyWatcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan struct{}, 1),
+	}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := w.file.Read(buf); err != nil {
+				// Before Go 1.9 files are not read through the runtime
+				// poller, so a read without events fails with EAGAIN
+				// instead of blocking.
+				if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EAGAIN {
+					time.Sleep(inotifyRetryInterval)
+					continue
+				}
+				return
+			}
+			select {
+			case w.events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+func (w *inotifyWatcher) watch(dir string) error {
+	_, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	return err
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.file.Close()
+}
+
+func unmetConditions(conds []waitCondition) []waitCondition {
+	unmet := []waitCondition{}
+	for _, cond := range conds {
+		if !cond.met() {
+			unmet = append(unmet, cond)
+		}
+	}
+	return unmet
+}
+
+func describeConditions(conds []waitCondition) string {
+	descriptions := []string{}
+	for _, cond := range conds {
+		descriptions = append(descriptions, cond.String())
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// waitForFiles blocks until all conditions are met at the same time. It uses
+// inotify to react to changes and falls back to polling where inotify is not
+// available. A timeout of 0 waits forever.
+func waitForFiles(conds []waitCondition, timeout time.Duration) error {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	var events <-chan struct{}
+	interval := waitPollInterval
+	watcher, err := newInotifyWatcher()
+	if err != nil {
+		logrus.Debugf("inotify is not available, polling instead: %v", err)
+	} else {
+		defer watcher.Close()
+		events = watcher.events
+		interval = waitRecheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	logged := false
+	for {
+		// Watch before checking so no change is missed in between.
+		if watcher != nil {
+			for _, cond := range conds {
+				if err := watcher.watch(cond.watchDir()); err != nil {
+					logrus.Debugf("Failed to watch %s: %v", cond.watchDir(), err)
+				}
+			}
+		}
+
+		unmet := unmetConditions(conds)
+		if len(unmet) == 0 {
+			return nil
+		}
+		if !logged {
+			logrus.Infof("Waiting for %s", describeConditions(unmet))
+			logged = true
+		}
+
+		select {
+		case <-events:
+		case <-ticker.C:
+		case <-deadline:
+			return fmt.Errorf("Timed out after %v waiting for %s", timeout, describeConditions(unmet))
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	endpointRetryMin     = 1 * time.Second
+	endpointRetryMax     = 10 * time.Second
+	endpointRetryBackoff = 1.5
+)
+
+// endpointWait blocks until all, or any, of its endpoints pass the same
+// checks as the probe command.
+type endpointWait struct {
+	endpoints   []string
+	any         bool
+	timeout     time.Duration
+	metadataURL string
+	mdClient    metadata.Client
+}
+
+func newEndpointWait(w WaitConfig, metadataURL string) (*endpointWait, error) {
+	if len(w.Endpoints) == 0 {
+		return nil, nil
+	}
+
+	e := &endpointWait{
+		endpoints:   w.Endpoints,
+		metadataURL: metadataURL,
+	}
+
+	switch w.EndpointMode {
+	case "", "all":
+	case "any":
+		e.any = true
+	default:
+		return nil, fmt.Errorf("Invalid endpoint wait mode %q, expected all or any", w.EndpointMode)
+	}
+
+	timeout, err := parseDuration("endpoint timeout", w.EndpointTimeout)
+	if err != nil {
+		return nil, err
+	}
+	e.timeout = timeout
+	if e.timeout == 0 {
+		e.timeout = 5 * time.Second
+	}
+
+	for _, endpoint := range e.endpoints {
+		if strings.HasPrefix(endpoint, "service://") {
+			if _, _, _, err := parseServiceEndpoint(endpoint); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid endpoint %q: %v", endpoint, err)
+		}
+		switch u.Scheme {
+		case "tcp", "http", "https":
+		default:
+			return nil, fmt.Errorf("Invalid endpoint %q, unsupported URL scheme %q", endpoint, u.Scheme)
+		}
+	}
+
+	return e, nil
+}
+
+// parseServiceEndpoint splits service://[stack/]service:port. The stack
+// defaults to the stack of this container.
+func parseServiceEndpoint(endpoint string) (string, string, string, error) {
+	spec := strings.TrimPrefix(endpoint, "service://")
+
+	stack := ""
+	if idx := strings.Index(spec, "/"); idx >= 0 {
+		stack, spec = spec[:idx], spec[idx+1:]
+	}
+
+	service, port, err := net.SplitHostPort(spec)
+	if err != nil || service == "" || port == "" {
+		return "", "", "", fmt.Errorf("Invalid endpoint %q, expected service://[stack/]service:port", endpoint)
+	}
+	return stack, service, port, nil
+}
+
+// expand replaces service:// endpoints with a tcp:// endpoint for every
+// container of the service. Services are looked up again on every attempt
+// since their containers may still be starting.
+func (e *endpointWait) expand(endpoint string) ([]string, error) {
+	if !strings.HasPrefix(endpoint, "service://") {
+		return []string{endpoint}, nil
+	}
+
+	stack, service, port, err := parseServiceEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.mdClient == nil {
+		if e.mdClient, err = metadata.NewClientAndWait(e.metadataURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if stack == "" {
+		self, err := e.mdClient.GetSelfContainer()
+		if err != nil {
+			return nil, err
+		}
+		stack = self.StackName
+	}
+
+	containers, err := e.mdClient.GetServiceContainers(service, stack)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := []string{}
+	for _, container := range containers {
+		if container.PrimaryIp != "" {
+			endpoints = append(endpoints, "tcp://"+net.JoinHostPort(container.PrimaryIp, port))
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("service has no containers")
+	}
+	return endpoints, nil
+}
+
+// check probes every endpoint in parallel and returns the failures, or nil
+// once the endpoints are healthy.
+func (e *endpointWait) check() []error {
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		failures []error
+		healthy  int
+	)
+
+	fail := func(endpoint string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		failures = append(failures, fmt.Errorf("%s: %s", endpoint, strings.TrimSpace(err.Error())))
+	}
+
+	for _, endpoint := range e.endpoints {
+		expanded, err := e.expand(endpoint)
+		if err != nil {
+			fail(endpoint, err)
+			continue
+		}
+
+		for _, target := range expanded {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				if err := healthCheck(target, newProbeOptions(e.timeout)); err != nil {
+					fail(target, err)
+					return
+				}
+				lock.Lock()
+				healthy++
+				lock.Unlock()
+			}(target)
+		}
+	}
+	wg.Wait()
+
+	if len(failures) == 0 || (e.any && healthy > 0) {
+		return nil
+	}
+	return failures
+}
+
+// wait retries with backoff until the endpoints are healthy or the
+// deadline, if any, has passed.
+func (e *endpointWait) wait(deadline time.Time) error {
+	delay := endpointRetryMin
+	for {
+		failures := e.check()
+		if failures == nil {
+			return nil
+		}
+
+		msgs := []string{}
+		for _, failure := range failures {
+			msgs = append(msgs, failure.Error())
+		}
+		sleep := delay
+		if !deadline.IsZero() {
+			remaining := deadline.Sub(time.Now())
+			if remaining <= 0 {
+				return fmt.Errorf("Timed out waiting for endpoints: %s", strings.Join(msgs, "; "))
+			}
+			if remaining < sleep {
+				sleep = remaining
+			}
+		}
+
+		logrus.Infof("Waiting for endpoints: %s", strings.Join(msgs, "; "))
+		time.Sleep(sleep)
+
+		delay = time.Duration(float64(delay) * endpointRetryBackoff)
+		if delay > endpointRetryMax {
+			delay = endpointRetryMax
+		}
+	}
+}
+
+// waitForAll waits for the file conditions, then for the endpoints, within
+// one overall timeout. A timeout of 0 waits forever.
+func waitForAll(conds []waitCondition, endpoints *endpointWait, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	if len(conds) > 0 {
+		if err := waitForFiles(conds, timeout); err != nil {
+			return err
+		}
+	}
+
+	if endpoints == nil {
+		return nil
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return fmt.Errorf("Timed out waiting for endpoints")
+	}
+	return endpoints.wait(deadline)
+}
@@ -0,0 +1,132 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitConditionMet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{
+		"empty":       "",
+		"status":      "starting\nready\n",
+		"run/a.pid":   "1",
+		"run/b.pid":   "2",
+		"run/c.other": "3",
+	}, nil)
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	tests := []struct {
+		name   string
+		config WaitConfig
+		met    bool
+	}{
+		{"exists", WaitConfig{Files: []string{path("empty")}}, true},
+		{"does not exist", WaitConfig{Files: []string{path("missing")}}, false},
+		{"nonempty", WaitConfig{NonEmpty: []string{path("status")}}, true},
+		{"empty", WaitConfig{NonEmpty: []string{path("empty")}}, false},
+		{"nonempty missing", WaitConfig{NonEmpty: []string{path("missing")}}, false},
+		{"match", WaitConfig{Match: []string{path("status") + "=(?m)^ready$"}}, true},
+		{"no match", WaitConfig{Match: []string{path("status") + "=(?m)^failed$"}}, false},
+		{"match missing", WaitConfig{Match: []string{path("missing") + "=.*"}}, false},
+		{"glob", WaitConfig{Globs: []string{path("run/*.pid")}}, true},
+		{"glob count", WaitConfig{Globs: []string{path("run/*.pid") + "=2"}}, true},
+		{"glob count not reached", WaitConfig{Globs: []string{path("run/*.pid") + "=3"}}, false},
+		{"glob in directory part", WaitConfig{Globs: []string{path("*/c.other")}}, true},
+		{"absent", WaitConfig{Absent: []string{path("missing")}}, true},
+		{"not absent", WaitConfig{Absent: []string{path("empty")}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conds, err := newWaitConditions(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(conds) != 1 {
+				t.Fatalf("got %d conditions, want 1", len(conds))
+			}
+			if met := conds[0].met(); met != test.met {
+				t.Fatalf("%s: met is %v, want %v", conds[0], met, test.met)
+			}
+		})
+	}
+}
+
+func TestNewWaitConditionsErrors(t *testing.T) {
+	tests := []struct {
+		config  WaitConfig
+		message string
+	}{
+		{WaitConfig{Match: []string{"/tmp/status"}}, "expected PATH=REGEX"},
+		{WaitConfig{Match: []string{"/tmp/status=("}}, "Invalid --wait-for-match"},
+		{WaitConfig{Globs: []string{"/tmp/*.pid=0"}}, "expected PATTERN[=COUNT]"},
+		{WaitConfig{Globs: []string{"/tmp/*.pid=x"}}, "expected PATTERN[=COUNT]"},
+		{WaitConfig{Globs: []string{"/tmp/[.pid"}}, "Invalid --wait-for-glob"},
+	}
+	for _, test := range tests {
+		if _, err := newWaitConditions(test.config); err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%+v: got %v, want %q", test.config, err, test.message)
+		}
+	}
+}
+
+func TestWaitForFilesTimeout(t *testing.T) {
+	conds, err := newWaitConditions(WaitConfig{Files: []string{"/nonexistent/ready"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = waitForFiles(conds, 200*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "Timed out after 200ms waiting for /nonexistent/ready to exist") {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+}
+
+func TestWaitForFilesChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{"lock": ""}, nil)
+
+	// The file appears in a directory that does not exist yet, and the lock
+	// goes away. Both must be noticed through inotify, well before
+	// waitRecheckInterval.
+	ready := filepath.Join(dir, "sub", "ready")
+	conds, err := newWaitConditions(WaitConfig{
+		Match:  []string{ready + "=ok"},
+		Absent: []string{filepath.Join(dir, "lock")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		os.Mkdir(filepath.Dir(ready), 0755)
+		time.Sleep(200 * time.Millisecond)
+		ioutil.WriteFile(ready, []byte("ok"), 0644)
+		time.Sleep(200 * time.Millisecond)
+		os.Remove(filepath.Join(dir, "lock"))
+	}()
+
+	start := time.Now()
+	if err := waitForFiles(conds, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("waited %v for changes made after 600ms", elapsed)
+	}
+}
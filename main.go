@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 
+	"github.com/Sirupsen/logrus"
 	giddyupApp "github.com/rancher/giddyup/app"
 	"github.com/rancher/giddyup/version"
 	"github.com/urfave/cli"
@@ -24,13 +25,18 @@ func main() {
 	}
 
 	app.Commands = []cli.Command{
+		giddyupApp.CloudInitCommand(),
 		giddyupApp.ExecCommand(),
 		giddyupApp.HealthCommand(),
 		giddyupApp.IPCommand(),
 		giddyupApp.LeaderCommand(),
 		giddyupApp.ProbeCommand(),
+		giddyupApp.RunCommand(),
 		giddyupApp.ServiceCommand(),
+		giddyupApp.TemplateCommand(),
 	}
 
-	app.Run(os.Args)
+	if err := app.Run(os.Args); err != nil {
+		logrus.Fatal(err)
+	}
 }